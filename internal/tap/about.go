@@ -0,0 +1,77 @@
+package tap
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/invopop/jsonschema"
+	"io"
+	"strings"
+)
+
+const Name = "tap-riot"
+
+// Version is set at build time with
+// -ldflags "-X github.com/nmorvil/singer-tap-riot/internal/tap.Version=...".
+var Version = "dev"
+
+// About is the --about output orchestrators such as Meltano use to discover
+// what the tap supports.
+type About struct {
+	Name         string             `json:"name"`
+	Description  string             `json:"description"`
+	Version      string             `json:"version"`
+	Capabilities []string           `json:"capabilities"`
+	Settings     *jsonschema.Schema `json:"settings"`
+}
+
+// GetAbout describes the tap. Its settings are reflected from Config.
+func GetAbout() About {
+	reflector := jsonschema.Reflector{
+		DoNotReference: true,
+	}
+	settings := reflector.Reflect(new(Config))
+	settings.Version = ""
+	settings.ID = ""
+
+	return About{
+		Name:         Name,
+		Description:  "Singer tap for the League of Legends data of the Riot Games API",
+		Version:      Version,
+		Capabilities: []string{"catalog", "discover", "properties", "state"},
+		Settings:     settings,
+	}
+}
+
+// WriteAbout writes the about information as "json" or as human readable
+// "text".
+func WriteAbout(w io.Writer, format string) error {
+	about := GetAbout()
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(about)
+	case "text":
+		var b strings.Builder
+		fmt.Fprintf(&b, "Name: %s\n", about.Name)
+		fmt.Fprintf(&b, "Description: %s\n", about.Description)
+		fmt.Fprintf(&b, "Version: %s\n", about.Version)
+		fmt.Fprintf(&b, "Capabilities: %s\n", strings.Join(about.Capabilities, ", "))
+		fmt.Fprintf(&b, "Settings:\n")
+		required := make(map[string]bool)
+		for _, name := range about.Settings.Required {
+			required[name] = true
+		}
+		for pair := about.Settings.Properties.Oldest(); pair != nil; pair = pair.Next() {
+			kind := pair.Value.Type
+			if required[pair.Key] {
+				kind += ", required"
+			}
+			fmt.Fprintf(&b, "  %s (%s): %s\n", pair.Key, kind, pair.Value.Description)
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	default:
+		return fmt.Errorf("unknown about format %q, expected json or text", format)
+	}
+}
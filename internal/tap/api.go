@@ -0,0 +1,31 @@
+package tap
+
+import (
+	"context"
+	"github.com/KnutZuidema/golio/riot/account"
+	"github.com/KnutZuidema/golio/riot/lol"
+	"time"
+)
+
+// RiotAPI is what the streams get their data from. The sync code only sees
+// this interface: RiotService implements it on top of golio and the Riot API,
+// or of an archive when replaying, and tests use an in-memory fake.
+//
+// Every call is cancelled with its ctx. Errors should be the typed errors of
+// api_errors.go, so that the sync can tell a rejected key or a rate limit from
+// a missing player.
+type RiotAPI interface {
+	// GetAccount returns the account of a player given as gameName#tagLine.
+	GetAccount(ctx context.Context, player string) (*account.Account, error)
+	// ListMatchIDs lists a page of the ids of the matches of queueId, or of
+	// every queue if zero, the player with the given puuid played between
+	// from and to: at most count ids, newest first, skipping the first start.
+	ListMatchIDs(ctx context.Context, puuid string, from, to time.Time, queueId, start, count int) ([]string, error)
+	GetMatch(ctx context.Context, matchId string) (*lol.Match, error)
+	GetTimeline(ctx context.Context, matchId string) (*MatchTimeline, error)
+	// GetLeagueEntries returns the ranked entries, one per queue, of the
+	// player with the given puuid.
+	GetLeagueEntries(ctx context.Context, puuid string) ([]*lol.LeagueItem, error)
+}
+
+var _ RiotAPI = (*RiotService)(nil)
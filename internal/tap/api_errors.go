@@ -0,0 +1,113 @@
+package tap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError describes a failed call to the Riot API. Errors of the more
+// specific types below embed it, so every failure carries the endpoint it hit,
+// the routing value or platform it was sent to and the index of the API key in
+// Config.APIKeys. Statuses without a dedicated type are returned as is.
+type APIError struct {
+	StatusCode int
+	Endpoint   string
+	Region     string
+	KeyIndex   int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("riot api: %s returned %d %s (region %s, key %d)",
+		e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode), e.Region, e.KeyIndex)
+}
+
+func (e *APIError) apiError() *APIError {
+	return e
+}
+
+// NotFoundError is returned for 404s, e.g. a Riot ID that does not exist or a
+// match without a timeline.
+type NotFoundError struct {
+	APIError
+}
+
+// RateLimitedError is returned for 429s that were still rate limited after
+// retrying. RetryAfter is the delay Riot asked for.
+type RateLimitedError struct {
+	APIError
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.APIError.Error(), e.RetryAfter)
+}
+
+// UnauthorizedError is returned for 401s and 403s: the key is missing,
+// expired or not allowed to call the endpoint.
+type UnauthorizedError struct {
+	APIError
+}
+
+// ServerError is returned for 5xx responses.
+type ServerError struct {
+	APIError
+}
+
+// DecodeError is returned when a successful response could not be decoded.
+type DecodeError struct {
+	APIError
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("riot api: failed to decode %s response (region %s, key %d): %s",
+		e.Endpoint, e.Region, e.KeyIndex, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// asAPIError returns the APIError embedded in any of the typed errors in
+// err's chain.
+func asAPIError(err error) (*APIError, bool) {
+	var target interface{ apiError() *APIError }
+	if !errors.As(err, &target) {
+		return nil, false
+	}
+	return target.apiError(), true
+}
+
+// newAPIError builds the typed error matching an error response.
+func newAPIError(resp *http.Response, endpoint, region string, keyIndex int) error {
+	base := APIError{
+		StatusCode: resp.StatusCode,
+		Endpoint:   endpoint,
+		Region:     region,
+		KeyIndex:   keyIndex,
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return &NotFoundError{base}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitedError{base, retryAfter(resp.Header)}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &UnauthorizedError{base}
+	case resp.StatusCode >= 500:
+		return &ServerError{base}
+	default:
+		return &base
+	}
+}
+
+// retryAfter parses the Retry-After header, defaulting to one second.
+func retryAfter(h http.Header) time.Duration {
+	seconds, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
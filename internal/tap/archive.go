@@ -0,0 +1,180 @@
+package tap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// archiveIndex is the name of the index file of an archive.
+const archiveIndex = "index.jsonl"
+
+// archivedEndpoints are the endpoints whose responses are archived: the ones
+// the streams are built from.
+var archivedEndpoints = map[string]bool{
+	endpointAccountByRiotID: true,
+	endpointMatchIDs:        true,
+	endpointMatch:           true,
+	endpointTimeline:        true,
+	endpointLeagueEntries:   true,
+}
+
+// archiveEntry is a line of the index of an archive: which request got the
+// response stored under SHA256.
+type archiveEntry struct {
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	URL      string    `json:"url"`
+	SHA256   string    `json:"sha256"`
+}
+
+// archive stores raw API responses in a directory, so that they can be
+// reprocessed without calling the API again. Responses are gzipped and
+// content-addressed, under objects/<first 2 hex digits>/<sha256>.json.gz, so
+// a match fetched by several runs is stored once. index.jsonl gets a line per
+// archived response, unless it is the one last indexed for its URL, e.g. a
+// response served from the cache. It is safe for concurrent use.
+type archive struct {
+	dir   string
+	mu    sync.Mutex
+	index *os.File
+	// latest is the hash last indexed for each URL.
+	latest map[string]string
+}
+
+func openArchive(dir string) (*archive, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	latest, err := readArchiveIndex(filepath.Join(dir, archiveIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	index, err := os.OpenFile(filepath.Join(dir, archiveIndex), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	return &archive{dir: dir, index: index, latest: latest}, nil
+}
+
+// readArchiveIndex returns the hash last indexed for each URL of an index,
+// which may not exist yet. Lines that do not decode, such as one cut short
+// by a crash, are skipped.
+func readArchiveIndex(path string) (map[string]string, error) {
+	latest := make(map[string]string)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return latest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry archiveEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			latest[entry.URL] = entry.SHA256
+		}
+	}
+	return latest, scanner.Err()
+}
+
+func (a *archive) Close() error {
+	return a.index.Close()
+}
+
+// validSum reports whether sum is a hex encoded SHA-256, as objects are
+// stored under.
+func validSum(sum string) bool {
+	b, err := hex.DecodeString(sum)
+	return err == nil && len(b) == sha256.Size
+}
+
+func (a *archive) objectPath(sum string) string {
+	return filepath.Join(a.dir, "objects", sum[:2], sum+".json.gz")
+}
+
+// store archives the body of the response to req.
+func (a *archive) store(req *http.Request, endpoint string, body []byte) error {
+	hash := sha256.Sum256(body)
+	sum := hex.EncodeToString(hash[:])
+	url := req.URL.String()
+	a.mu.Lock()
+	indexed := a.latest[url] == sum
+	a.mu.Unlock()
+	if indexed {
+		return nil
+	}
+	if err := a.writeObject(sum, body); err != nil {
+		return fmt.Errorf("failed to archive response: %w", err)
+	}
+
+	line, err := json.Marshal(archiveEntry{
+		Time:     time.Now().UTC(),
+		Endpoint: endpoint,
+		URL:      url,
+		SHA256:   sum,
+	})
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.index.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to archive response: %w", err)
+	}
+	a.latest[url] = sum
+	return nil
+}
+
+// writeObject writes body unless it is already archived. It goes through a
+// temporary file so that an interrupted write never leaves a truncated
+// object behind.
+func (a *archive) writeObject(sum string, body []byte) error {
+	path := a.objectPath(sum)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), sum+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := gzip.NewWriter(f)
+	if _, err := w.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// archiveResponse archives body as the response to req.
+func (t *transport) archiveResponse(req *http.Request, body []byte) error {
+	endpoint := endpointName(req.URL.Path)
+	if !archivedEndpoints[endpoint] {
+		return nil
+	}
+	return t.archive.store(req, endpoint, body)
+}
@@ -0,0 +1,33 @@
+package tap
+
+import "time"
+
+// timeWindow is a [Start, End] slice of the sync range. Match ids are listed
+// per window and the player's bookmark only advances to End once every match
+// of the window has been emitted, and no match of the stream was skipped
+// before.
+type timeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// backfillWindows splits [from, to] into consecutive windows of at most size.
+// A zero size yields a single window covering the whole range, and an empty
+// range yields no window at all.
+func backfillWindows(from, to time.Time, size time.Duration) []timeWindow {
+	if !from.Before(to) {
+		return nil
+	}
+	if size <= 0 {
+		return []timeWindow{{from, to}}
+	}
+	var windows []timeWindow
+	for start := from; start.Before(to); start = start.Add(size) {
+		end := start.Add(size)
+		if end.After(to) {
+			end = to
+		}
+		windows = append(windows, timeWindow{start, end})
+	}
+	return windows
+}
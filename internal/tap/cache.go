@@ -0,0 +1,124 @@
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFile is the name of the database of a cache directory.
+const cacheFile = "cache.db"
+
+// defaultCacheTTL is how long mutable responses stay cached when
+// cache_ttl_minutes is not set.
+const defaultCacheTTL = time.Hour
+
+// cachedEndpoints are the endpoints whose responses are cached, and whether
+// they expire. Matches and timelines never change once the game is over;
+// accounts and league entries do, so they are only reused for the TTL of the
+// cache. Match id lists grow with every game and are never cached.
+var cachedEndpoints = map[string]bool{
+	endpointMatch:           false,
+	endpointTimeline:        false,
+	endpointAccountByRiotID: true,
+	endpointLeagueEntries:   true,
+}
+
+// responseCache keeps the bodies of successful responses on disk, so that a
+// rerun after a crash or with another catalog does not download them again.
+// It is a bbolt database with a bucket per endpoint, keyed by request URL,
+// each value being the time it was stored, in big-endian Unix nanoseconds,
+// followed by the body. Expired entries are overwritten when fetched again.
+// It is safe for concurrent use, but a cache directory can only be used by
+// one run at a time.
+type responseCache struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+func openCache(dir string, ttl time.Duration) (*responseCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to open cache: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, cacheFile), 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache, is another run using it? %w", err)
+	}
+	return &responseCache{db: db, ttl: ttl}, nil
+}
+
+func (c *responseCache) Close() error {
+	return c.db.Close()
+}
+
+// get returns the cached body of the response to url, unless there is none
+// or it expired.
+func (c *responseCache) get(endpoint, url string, now time.Time) ([]byte, bool) {
+	var body []byte
+	var stored time.Time
+	err := c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(endpoint))
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get([]byte(url))
+		if len(value) < 8 {
+			return nil
+		}
+		stored = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+		// value is only valid during the transaction.
+		body = bytes.Clone(value[8:])
+		return nil
+	})
+	if err != nil || body == nil {
+		cacheLookupsTotal.WithLabelValues(endpoint, "miss").Inc()
+		return nil, false
+	}
+	if cachedEndpoints[endpoint] && now.Sub(stored) > c.ttl {
+		cacheLookupsTotal.WithLabelValues(endpoint, "expired").Inc()
+		return nil, false
+	}
+	cacheLookupsTotal.WithLabelValues(endpoint, "hit").Inc()
+	return body, true
+}
+
+// put caches body as the response to url.
+func (c *responseCache) put(endpoint, url string, body []byte, now time.Time) error {
+	value := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(value, uint64(now.UnixNano()))
+	value = append(value, body...)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(endpoint))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(url), value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cache response: %w", err)
+	}
+	return nil
+}
+
+// cachedBody returns the cached body of the response to req, if any.
+func (t *transport) cachedBody(req *http.Request) ([]byte, bool) {
+	endpoint := endpointName(req.URL.Path)
+	if _, ok := cachedEndpoints[endpoint]; !ok {
+		return nil, false
+	}
+	return t.cache.get(endpoint, req.URL.String(), time.Now())
+}
+
+// cacheResponse caches body as the response to req.
+func (t *transport) cacheResponse(req *http.Request, body []byte) error {
+	endpoint := endpointName(req.URL.Path)
+	if _, ok := cachedEndpoints[endpoint]; !ok {
+		return nil
+	}
+	return t.cache.put(endpoint, req.URL.String(), body, time.Now())
+}
@@ -4,14 +4,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
+// Config is the tap's config file. The jsonschema_description tags document
+// the settings in the --about output.
 type Config struct {
-	APIKeys   []string `json:"api_keys"`
-	Server    string   `json:"server"`
-	Players   []string `json:"players,omitempty"`
-	StartDate string   `json:"start_date,omitempty"`
-	QueueId   int      `json:"queue_id,omitempty"`
+	APIKeys            []string `json:"api_keys" jsonschema_description:"Riot API keys, requests are spread over all of them"`
+	Server             string   `json:"server" jsonschema_description:"Platform the players are on, e.g. euw1 or na1"`
+	Players            []string `json:"players,omitempty" jsonschema_description:"Riot IDs of the players to sync, as gameName#tagLine"`
+	StartDate          string   `json:"start_date,omitempty" jsonschema_description:"Date (YYYY-MM-DD) to sync from for players without a bookmark"`
+	EndDate            string   `json:"end_date,omitempty" jsonschema_description:"Date (YYYY-MM-DD) to sync up to, included, defaults to now"`
+	BackfillWindowDays int      `json:"backfill_window_days,omitempty" jsonschema_description:"Split the sync range into windows of this many days, checkpointing state after each"`
+	QueueId            int      `json:"queue_id,omitempty" jsonschema_description:"Only sync matches of this queue, e.g. 420 for ranked solo"`
+	// MaxFailures caps, per stream, how many players or matches may be
+	// skipped before the run is aborted. Streams without an entry never abort.
+	MaxFailures      map[string]int `json:"max_failures,omitempty" jsonschema_description:"Per stream, how many players or matches may be skipped before the run is aborted"`
+	RecordValidation string         `json:"record_validation,omitempty" jsonschema:"enum=,enum=fail,enum=drop,enum=pass" jsonschema_description:"Check records against their schema: fail the run, drop invalid records or only log them"`
+	ArchiveDir       string         `json:"archive_dir,omitempty" jsonschema_description:"Directory to archive the raw API responses in, gzipped and content-addressed, for reprocessing without API calls"`
+	CacheDir         string         `json:"cache_dir,omitempty" jsonschema_description:"Directory to cache API responses in, so that reruns do not download matches and timelines again"`
+	CacheTTLMinutes  int            `json:"cache_ttl_minutes,omitempty" jsonschema_description:"How long cached accounts and league entries are reused, defaults to 60"`
+	LaneDiffMinutes  []int          `json:"lane_diff_minutes,omitempty" jsonschema_description:"Minute marks of the timeline_lane_diffs stream, defaults to 5, 10, 15 and 20"`
+
+	// ReplayDir is an archive to replay instead of calling the API, set with
+	// --replay.
+	ReplayDir string `json:"-"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -28,3 +45,57 @@ func LoadConfig(path string) (*Config, error) {
 
 	return &config, nil
 }
+
+// endTime returns the upper bound of the sync range: the end of the day of
+// end_date when set, otherwise now. An end_date before start_date is an
+// error, since the run would silently sync nothing.
+func (c *Config) endTime(now time.Time) (time.Time, error) {
+	if c.EndDate == "" {
+		return now, nil
+	}
+	endDate, err := startDateAsTime(c.EndDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid end date %q: %w", c.EndDate, err)
+	}
+	if c.StartDate != "" {
+		start, err := startDateAsTime(c.StartDate)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid start date %q: %w", c.StartDate, err)
+		}
+		if endDate.Before(start) {
+			return time.Time{}, fmt.Errorf("end date %s is before start date %s", c.EndDate, c.StartDate)
+		}
+	}
+	end := endDate.AddDate(0, 0, 1)
+	if end.After(now) {
+		return now, nil
+	}
+	return end, nil
+}
+
+// backfillWindow returns the size of the slices a sync range is split into,
+// or zero when backfill mode is disabled.
+func (c *Config) backfillWindow() time.Duration {
+	return time.Duration(c.BackfillWindowDays) * 24 * time.Hour
+}
+
+// cacheTTL returns how long cached accounts and league entries are reused.
+func (c *Config) cacheTTL() time.Duration {
+	if c.CacheTTLMinutes <= 0 {
+		return defaultCacheTTL
+	}
+	return time.Duration(c.CacheTTLMinutes) * time.Minute
+}
+
+// laneDiffMinutes returns the minute marks of the timeline_lane_diffs stream.
+func (c *Config) laneDiffMinutes() ([]int, error) {
+	if len(c.LaneDiffMinutes) == 0 {
+		return defaultLaneDiffMinutes, nil
+	}
+	for _, minute := range c.LaneDiffMinutes {
+		if minute <= 0 {
+			return nil, fmt.Errorf("invalid lane diff minute %d", minute)
+		}
+	}
+	return c.LaneDiffMinutes, nil
+}
@@ -0,0 +1,152 @@
+package tap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Skip records a player or match that was left out of a sync because of err.
+// MatchID is empty when the whole player was skipped.
+type Skip struct {
+	Stream  string
+	Player  string
+	MatchID string
+	Err     error
+}
+
+// FatalError aborts a sync: no API key is left, a stream went over its
+// failure threshold, or the output could not be written. Stream is empty when
+// the whole run is concerned.
+type FatalError struct {
+	Stream string
+	Err    error
+}
+
+func (e *FatalError) Error() string {
+	if e.Stream == "" {
+		return fmt.Sprintf("sync failed: %s", e.Err)
+	}
+	return fmt.Sprintf("sync of %s failed: %s", e.Stream, e.Err)
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned by RunSync when every stream ran to completion but
+// some players or matches had to be skipped. The bookmarks are left before
+// them, so the next run tries them again.
+type PartialError struct {
+	Skipped []Skip
+}
+
+func (e *PartialError) Error() string {
+	counts := make(map[string]int)
+	for _, skip := range e.Skipped {
+		counts[skip.Stream]++
+	}
+	streams := make([]string, 0, len(counts))
+	for stream := range counts {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	parts := make([]string, len(streams))
+	for i, stream := range streams {
+		parts[i] = fmt.Sprintf("%s: %d", stream, counts[stream])
+	}
+	return fmt.Sprintf("partial sync, %d items skipped (%s)", len(e.Skipped), strings.Join(parts, ", "))
+}
+
+// isFatal reports whether err means the API key itself was rejected, in which
+// case every further request would fail as well.
+func isFatal(err error) bool {
+	var unauthorized *UnauthorizedError
+	return errors.As(err, &unauthorized)
+}
+
+// runSummary collects the failures of a sync run and decides when they are
+// bad enough to abort it. It is shared by all workers and safe for concurrent
+// use.
+type runSummary struct {
+	mu      sync.Mutex
+	limits  map[string]int
+	counts  map[string]int
+	skipped []Skip
+	fatal   *FatalError
+	cancel  context.CancelFunc
+
+	// For the report.
+	started time.Time
+	players map[string]map[string]*PlayerReport
+}
+
+func newRunSummary(limits map[string]int, cancel context.CancelFunc) *runSummary {
+	return &runSummary{
+		limits:  limits,
+		counts:  make(map[string]int),
+		cancel:  cancel,
+		started: time.Now(),
+		players: make(map[string]map[string]*PlayerReport),
+	}
+}
+
+// skip records a skipped player or match and cancels the run if the error is
+// fatal or the stream went over its threshold.
+func (r *runSummary) skip(stream, player, matchId string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.skipped = append(r.skipped, Skip{stream, player, matchId, err})
+	r.counts[stream]++
+
+	if r.fatal != nil {
+		return
+	}
+	if isFatal(err) {
+		r.fatal = &FatalError{stream, err}
+	} else if limit := r.limits[stream]; limit > 0 && r.counts[stream] > limit {
+		r.fatal = &FatalError{stream, fmt.Errorf("more than %d failures, last: %w", limit, err)}
+	}
+	if r.fatal != nil {
+		r.cancel()
+	}
+}
+
+// skips returns how many players or matches of stream were skipped.
+func (r *runSummary) skips(stream string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[stream]
+}
+
+// abort records a fatal error and cancels the run, unless it was already
+// aborted.
+func (r *runSummary) abort(err *FatalError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fatal == nil {
+		r.fatal = err
+		r.cancel()
+	}
+}
+
+// err returns the error RunSync should report: a *FatalError if the run was
+// aborted, a *PartialError if items were skipped, nil otherwise.
+func (r *runSummary) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fatal != nil {
+		return r.fatal
+	}
+	if len(r.skipped) > 0 {
+		return &PartialError{Skipped: r.skipped}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package tap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const endpointPlatformData = "lol-status-v4.getPlatformData"
+
+// keyClass is the kind of API key, as told by the rate limits Riot applies to
+// it. Development and personal keys share the same limits and cannot be told
+// apart, so both are classed as development keys. Only production keys get
+// more.
+type keyClass string
+
+const (
+	keyUnknown     keyClass = "unknown"
+	keyDevelopment keyClass = "development"
+	keyProduction  keyClass = "production"
+)
+
+// rateLimit is one "requests:seconds" entry of an X-App-Rate-Limit header.
+type rateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+func (l rateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Window)
+}
+
+// parseRateLimits parses a rate limit header such as "20:1,100:120".
+func parseRateLimits(header string) []rateLimit {
+	var limits []rateLimit
+	for _, part := range strings.Split(header, ",") {
+		requests, seconds, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			continue
+		}
+		r, err1 := strconv.Atoi(requests)
+		s, err2 := strconv.Atoi(seconds)
+		if err1 != nil || err2 != nil || r <= 0 || s <= 0 {
+			continue
+		}
+		limits = append(limits, rateLimit{r, time.Duration(s) * time.Second})
+	}
+	return limits
+}
+
+// classifyKey tells the key class from its application rate limits:
+// development and personal keys get 20 requests per second and 100 per two
+// minutes, so a key allowed more than that is a production key, however low
+// its limits.
+func classifyKey(limits []rateLimit) keyClass {
+	if len(limits) == 0 {
+		return keyUnknown
+	}
+	var perSecond float64
+	for i, l := range limits {
+		rate := float64(l.Requests) / l.Window.Seconds()
+		if i == 0 || rate < perSecond {
+			perSecond = rate
+		}
+	}
+	if perSecond > float64(requestsPerWindow)/windowSeconds {
+		return keyProduction
+	}
+	return keyDevelopment
+}
+
+// requestIntervalFor returns the spacing between requests that keeps a key
+// under all of its limits, with a 10% margin.
+func requestIntervalFor(limits []rateLimit) time.Duration {
+	var interval time.Duration
+	for _, l := range limits {
+		if i := l.Window / time.Duration(l.Requests); i > interval {
+			interval = i
+		}
+	}
+	return interval + interval/10
+}
+
+// probe checks the key against the cheap platform-data endpoint, then
+// classifies it and tunes its rate limiter from the limits Riot reports.
+func (r *RiotService) probe(ctx context.Context) error {
+	url := fmt.Sprintf("https://%s.api.riotgames.com/lol/status/v4/platform-data", r.region)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Riot-Token", r.apiKey)
+
+	resp, err := r.transport.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	limits := parseRateLimits(resp.Header.Get("X-App-Rate-Limit"))
+	r.class = classifyKey(limits)
+	r.limits = limits
+	if len(limits) > 0 {
+		r.transport.limiter.setInterval(requestIntervalFor(limits))
+	}
+	return nil
+}
+
+// checkHealth probes every key of the pool concurrently. Keys that Riot
+// rejects are quarantined; keys that could not be probed for another reason
+// are kept with the default rate limit.
+func (r *syncRun) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for key, riot := range r.pool.services {
+		service, ok := riot.(*RiotService)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := service.probe(ctx)
+			var unauthorized *UnauthorizedError
+			switch {
+			case err == nil:
+				r.log("API key checked", "key_index", key, "class", service.class,
+					"rate_limits", fmt.Sprint(service.limits), "interval", service.transport.limiter.currentInterval())
+			case errors.As(err, &unauthorized):
+				r.pool.quarantine(key, err)
+				r.logError("API key rejected, removing it from the pool", "key_index", key, "error", err)
+			case ctx.Err() == nil:
+				r.logWarn("API key could not be checked, keeping it", "key_index", key, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// logKeyHealth reports how many keys made it through the run.
+func (r *syncRun) logKeyHealth() {
+	healthy := len(r.pool.healthy())
+	r.log("API keys", "healthy", healthy, "quarantined", len(r.pool.services)-healthy)
+}
@@ -0,0 +1,85 @@
+package tap
+
+import (
+	"github.com/KnutZuidema/golio/riot/lol"
+)
+
+// killEvents are the timeline events of the timeline_kills stream: champion
+// kills, and the objectives taken.
+var killEvents = map[lol.MatchEventType]bool{
+	lol.MatchEventTypeChampionKill:     true,
+	lol.MatchEventTypeEliteMonsterKill: true,
+	lol.MatchEventTypeBuildingKill:     true,
+}
+
+// killsStream is the timeline_kills stream, which needs both the match, to
+// resolve participant ids, and its timeline.
+var killsStream = matchStream{
+	name:          TimelineKills,
+	needsMatch:    true,
+	needsTimeline: true,
+	records: func(matchId string, match *lol.Match, timeline *MatchTimeline) []interface{} {
+		return asRecords(timelineKills(matchId, match, timeline))
+	},
+}
+
+// timelineKills returns a Kill per champion kill, elite monster kill and
+// building kill of a match.
+//
+// A champion kill is a solo kill when a champion got it without assists, a
+// gank kill when it happened in a lane with the jungler of the killing team
+// taking part, and a shutdown when it paid a shutdown bounty.
+func timelineKills(matchId string, match *lol.Match, timeline *MatchTimeline) []*Kill {
+	participants := make(map[int]*lol.Participant)
+	if match.Info != nil {
+		for _, p := range match.Info.Participants {
+			participants[p.ParticipantID] = p
+		}
+	}
+
+	var kills []*Kill
+	for i, event := range timeline.Events {
+		if event.Type == nil || !killEvents[*event.Type] {
+			continue
+		}
+		kill := &Kill{
+			MatchID:        matchId,
+			EventIndex:     i,
+			Type:           string(*event.Type),
+			Timestamp:      event.Timestamp,
+			MonsterType:    event.MonsterType,
+			BuildingType:   event.BuildingType,
+			Zone:           ZoneUnknown,
+			ShutdownBounty: event.ShutdownBounty,
+		}
+		if event.Position != nil {
+			kill.X, kill.Y = event.Position.X, event.Position.Y
+			kill.Zone = mapZone(float64(event.Position.X), float64(event.Position.Y))
+		}
+		killer, ok := participants[event.KillerID]
+		if ok {
+			kill.KillerPuuid = killer.PUUID
+			kill.KillerChampion = killer.ChampionName
+			kill.KillerTeamID = killer.TeamID
+		}
+		if victim, ok := participants[event.VictimID]; ok {
+			kill.VictimPuuid = victim.PUUID
+			kill.VictimChampion = victim.ChampionName
+		}
+		junglerInvolved := ok && killer.TeamPosition == "JUNGLE"
+		for _, id := range event.AssistingParticipantIDs {
+			if assistant, ok := participants[id]; ok {
+				kill.AssistingPuuids = append(kill.AssistingPuuids, assistant.PUUID)
+				junglerInvolved = junglerInvolved || assistant.TeamPosition == "JUNGLE"
+			}
+		}
+
+		if *event.Type == lol.MatchEventTypeChampionKill {
+			kill.SoloKill = ok && len(event.AssistingParticipantIDs) == 0
+			kill.GankKill = junglerInvolved && laneZones[kill.Zone]
+			kill.Shutdown = event.ShutdownBounty > 0
+		}
+		kills = append(kills, kill)
+	}
+	return kills
+}
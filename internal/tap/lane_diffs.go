@@ -0,0 +1,110 @@
+package tap
+
+import (
+	"github.com/KnutZuidema/golio/riot/lol"
+)
+
+// defaultLaneDiffMinutes are the minute marks of the timeline_lane_diffs
+// stream when lane_diff_minutes is not set.
+var defaultLaneDiffMinutes = []int{5, 10, 15, 20}
+
+// laneDiffsStream returns the timeline_lane_diffs stream, which needs both the
+// match, for the positions of the players, and its timeline.
+func laneDiffsStream(minutes []int) matchStream {
+	return matchStream{
+		name:          TimelineLaneDiffs,
+		needsMatch:    true,
+		needsTimeline: true,
+		records: func(matchId string, match *lol.Match, timeline *MatchTimeline) []interface{} {
+			return asRecords(laneDiffs(matchId, match, timeline, minutes))
+		},
+	}
+}
+
+// laneDiffs returns a LaneDiff per player and minute mark of a match. Minute
+// marks past the end of the game are left out.
+func laneDiffs(matchId string, match *lol.Match, timeline *MatchTimeline, minutes []int) []*LaneDiff {
+	if match.Info == nil {
+		return nil
+	}
+	frames := make(map[string][]MatchFrame)
+	for _, frame := range timeline.Frames {
+		frames[frame.PlayerID] = append(frames[frame.PlayerID], frame)
+	}
+
+	var diffs []*LaneDiff
+	for _, minute := range minutes {
+		stats := make(map[string]*LaneDiff)
+		for _, p := range match.Info.Participants {
+			frame, ok := frameAt(frames[p.PUUID], minute)
+			if !ok {
+				continue
+			}
+			stats[p.PUUID] = &LaneDiff{
+				MatchID:      matchId,
+				Minute:       minute,
+				Puuid:        p.PUUID,
+				TeamID:       p.TeamID,
+				TeamPosition: p.TeamPosition,
+				ChampionName: p.ChampionName,
+				Gold:         frame.TotalGold,
+				XP:           frame.XP,
+				CS:           frame.MinionsKilled + frame.JungleMinionsKilled,
+				Damage:       frame.DamageStats.TotalDamageDoneToChampions,
+			}
+		}
+		for _, p := range match.Info.Participants {
+			diff, ok := stats[p.PUUID]
+			if !ok {
+				continue
+			}
+			if opponent := laneOpponent(match.Info.Participants, p); opponent != nil {
+				if theirs, ok := stats[opponent.PUUID]; ok {
+					diff.OpponentPuuid = opponent.PUUID
+					diff.GoldDiff = ptr(diff.Gold - theirs.Gold)
+					diff.XPDiff = ptr(diff.XP - theirs.XP)
+					diff.CSDiff = ptr(diff.CS - theirs.CS)
+					diff.DamageDiff = ptr(diff.Damage - theirs.Damage)
+				}
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+// frameAt returns the first frame at or after a minute mark. Frames are taken
+// every minute, a few milliseconds late, and the last one at the end of the
+// game.
+func frameAt(frames []MatchFrame, minute int) (MatchFrame, bool) {
+	mark := float64(minute * 60000)
+	for _, frame := range frames {
+		if frame.Timestamp >= mark {
+			return frame, true
+		}
+	}
+	return MatchFrame{}, false
+}
+
+// laneOpponent returns the player of the other team with the same position as
+// p, or nil if there is not exactly one.
+func laneOpponent(participants []*lol.Participant, p *lol.Participant) *lol.Participant {
+	if p.TeamPosition == "" {
+		return nil
+	}
+	var opponent *lol.Participant
+	for _, other := range participants {
+		if other.TeamID == p.TeamID || other.TeamPosition != p.TeamPosition {
+			continue
+		}
+		if opponent != nil {
+			return nil
+		}
+		opponent = other
+	}
+	return opponent
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
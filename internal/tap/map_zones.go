@@ -0,0 +1,74 @@
+package tap
+
+// Map zones of Summoner's Rift. The blue side (team 100) is the bottom left
+// corner of the map and the red side (team 200) the top right one.
+const (
+	ZoneBlueBase      = "blue_base"
+	ZoneRedBase       = "red_base"
+	ZoneTopLane       = "top_lane"
+	ZoneMidLane       = "mid_lane"
+	ZoneBotLane       = "bot_lane"
+	ZoneRiver         = "river"
+	ZoneBlueTopJungle = "blue_top_jungle"
+	ZoneBlueBotJungle = "blue_bot_jungle"
+	ZoneRedTopJungle  = "red_top_jungle"
+	ZoneRedBotJungle  = "red_bot_jungle"
+	ZoneUnknown       = "unknown"
+)
+
+type point struct {
+	x, y float64
+}
+
+// mapZones are the polygons of the zones of Summoner's Rift, in map
+// coordinates going from 0 to about 15000 on both axes. They overlap: a
+// position is in the first zone that contains it, so the bases and lanes win
+// over the river and the jungle quadrants, which are split by the river and
+// the mid lane and cover the rest of the map. The red side polygons mirror
+// the blue side ones through the center of the map.
+var mapZones = []struct {
+	zone    string
+	polygon []point
+}{
+	{ZoneBlueBase, []point{{0, 0}, {4300, 0}, {4300, 3000}, {3000, 4300}, {0, 4300}}},
+	{ZoneRedBase, []point{{15000, 15000}, {10700, 15000}, {10700, 12000}, {12000, 10700}, {15000, 10700}}},
+	{ZoneTopLane, []point{{0, 4300}, {2100, 4300}, {2100, 12900}, {10700, 12900}, {10700, 15000}, {0, 15000}}},
+	{ZoneBotLane, []point{{15000, 10700}, {12900, 10700}, {12900, 2100}, {4300, 2100}, {4300, 0}, {15000, 0}}},
+	{ZoneMidLane, []point{{4900, 3700}, {11300, 10100}, {10100, 11300}, {3700, 4900}}},
+	{ZoneRiver, []point{{1400, 12100}, {12100, 1400}, {13600, 2900}, {2900, 13600}}},
+	{ZoneBlueTopJungle, []point{{0, 0}, {7500, 7500}, {0, 15000}}},
+	{ZoneBlueBotJungle, []point{{0, 0}, {15000, 0}, {7500, 7500}}},
+	{ZoneRedTopJungle, []point{{0, 15000}, {7500, 7500}, {15000, 15000}}},
+	{ZoneRedBotJungle, []point{{15000, 0}, {15000, 15000}, {7500, 7500}}},
+}
+
+// laneZones are the zones a gank can happen in.
+var laneZones = map[string]bool{
+	ZoneTopLane: true,
+	ZoneMidLane: true,
+	ZoneBotLane: true,
+}
+
+// mapZone returns the zone of a position, or ZoneUnknown if it is off the
+// map.
+func mapZone(x, y float64) string {
+	for _, z := range mapZones {
+		if inPolygon(point{x, y}, z.polygon) {
+			return z.zone
+		}
+	}
+	return ZoneUnknown
+}
+
+// inPolygon reports whether p is inside polygon, by counting how many of its
+// edges a ray going right from p crosses.
+func inPolygon(p point, polygon []point) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < a.x+(p.y-a.y)*(b.x-a.x)/(b.y-a.y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,70 @@
+package tap
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// registry holds the Prometheus metrics of the tap. They are always updated
+// and only served when MetricsHandler is mounted.
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = newCounterVec("tap_riot_requests_total",
+		"Requests sent to the Riot API, by endpoint, HTTP status and API key index.",
+		"endpoint", "status", "key")
+	rateLimitWaitSeconds = newCounterVec("tap_riot_rate_limit_wait_seconds_total",
+		"Time spent waiting on rate limits, by API key index and cause: limiter or retry_after.",
+		"key", "cause")
+	requestRetriesTotal = newCounterVec("tap_riot_request_retries_total",
+		"Requests retried after a 429 or 503, by endpoint.",
+		"endpoint")
+	taskRetriesTotal = newCounterVec("tap_riot_task_retries_total",
+		"Tasks requeued after a transient error, by stream.",
+		"stream")
+	recordsTotal = newCounterVec("tap_riot_records_total",
+		"Records emitted, by stream.",
+		"stream")
+	playersCompletedTotal = newCounterVec("tap_riot_players_completed_total",
+		"Players whose sync completed, by stream.",
+		"stream")
+	cacheLookupsTotal = newCounterVec("tap_riot_cache_lookups_total",
+		"Response cache lookups, by endpoint and result: hit, miss or expired.",
+		"endpoint", "result")
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tap_riot_queue_depth",
+		Help: "Tasks waiting for a worker, by stream.",
+	}, []string{"stream"})
+	quarantinedKeys = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tap_riot_quarantined_keys",
+		Help: "API keys removed from the pool.",
+	})
+)
+
+func init() {
+	registry.MustRegister(queueDepth, quarantinedKeys)
+}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	registry.MustRegister(c)
+	return c
+}
+
+// MetricsHandler serves the Prometheus metrics of the tap.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func keyLabel(keyIndex int) string {
+	return strconv.Itoa(keyIndex)
+}
+
+func observeRateLimitWait(keyIndex int, cause string, d time.Duration) {
+	if d > 0 {
+		rateLimitWaitSeconds.WithLabelValues(keyLabel(keyIndex), cause).Add(d.Seconds())
+	}
+}
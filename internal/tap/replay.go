@@ -0,0 +1,158 @@
+package tap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/KnutZuidema/golio/api"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// replayTransport answers requests from an archive written with archive_dir
+// instead of the network, so that a sync can be rerun without API calls.
+//
+// A request gets the last response archived for the same URL. Match id lists
+// are requested up to the end of the run, which is now unless end_date is
+// set, so a list that is not archived for the exact URL is replayed from the
+// latest one archived for the same player and range start that does not go
+// past the requested end.
+type replayTransport struct {
+	archive *archive
+	urls    map[string]string
+	// matchLists holds the match id lists by URL without endTime, then by
+	// endTime.
+	matchLists map[string]map[int64]string
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	f, err := os.Open(filepath.Join(dir, archiveIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay archive: %w", err)
+	}
+	defer f.Close()
+
+	t := &replayTransport{
+		archive:    &archive{dir: dir},
+		urls:       make(map[string]string),
+		matchLists: make(map[string]map[int64]string),
+	}
+	// Lines that do not decode, such as one cut short by a crash, are skipped
+	// like when the archive is opened. One that decodes to a bad hash means
+	// the index is corrupt.
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry archiveEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !validSum(entry.SHA256) {
+			return nil, fmt.Errorf("invalid replay archive index, line %d: bad sha256 %q", line, entry.SHA256)
+		}
+		t.urls[entry.URL] = entry.SHA256
+		if entry.Endpoint == endpointMatchIDs {
+			if key, end, ok := matchListKey(entry.URL); ok {
+				if t.matchLists[key] == nil {
+					t.matchLists[key] = make(map[int64]string)
+				}
+				t.matchLists[key][end] = entry.SHA256
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read replay archive: %w", err)
+	}
+	return t, nil
+}
+
+// matchListKey splits the URL of a match id list into the URL without its
+// endTime and the endTime.
+func matchListKey(rawURL string) (string, int64, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", 0, false
+	}
+	query := u.Query()
+	end, err := strconv.ParseInt(query.Get("endTime"), 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	query.Del("endTime")
+	u.RawQuery = query.Encode()
+	return u.String(), end, true
+}
+
+// lookup returns the hash of the response to replay for rawURL.
+func (t *replayTransport) lookup(rawURL string) (string, bool) {
+	if sum, ok := t.urls[rawURL]; ok {
+		return sum, true
+	}
+	key, end, ok := matchListKey(rawURL)
+	if !ok {
+		return "", false
+	}
+	var sum string
+	best := int64(-1)
+	for archivedEnd, archivedSum := range t.matchLists[key] {
+		if archivedEnd <= end && archivedEnd > best {
+			best, sum = archivedEnd, archivedSum
+		}
+	}
+	return sum, best >= 0
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sum, ok := t.lookup(req.URL.String())
+	if !ok {
+		return nil, fmt.Errorf("no archived response for %s", req.URL.Path)
+	}
+	body, err := t.archive.load(sum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archived response: %w", err)
+	}
+	return storedResponse(req, body), nil
+}
+
+// load returns the body archived under sum.
+func (a *archive) load(sum string) ([]byte, error) {
+	f, err := os.Open(a.objectPath(sum))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// newReplayServices returns a single service replaying c.ReplayDir. It goes
+// through the same transport and decoding as the network, without rate
+// limiting.
+func newReplayServices(ctx context.Context, c *Config, metrics metricWriter) ([]RiotAPI, error) {
+	replay, err := newReplayTransport(c.ReplayDir)
+	if err != nil {
+		return nil, err
+	}
+	t := &transport{
+		ctx:     ctx,
+		client:  &http.Client{Transport: replay},
+		limiter: &rateLimiter{},
+		metrics: metrics,
+	}
+	region := api.Region(c.Server)
+	service := &RiotService{
+		transport: t,
+		region:    region,
+		class:     keyUnknown,
+	}
+	return []RiotAPI{service}, nil
+}
@@ -0,0 +1,167 @@
+package tap
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Statuses of a Report.
+const (
+	StatusSucceeded   = "succeeded"
+	StatusPartial     = "partial"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+// Report summarizes a sync run, for people and tools checking on it.
+type Report struct {
+	Status          string                   `json:"status"`
+	Error           string                   `json:"error,omitempty"`
+	StartedAt       time.Time                `json:"started_at"`
+	FinishedAt      time.Time                `json:"finished_at"`
+	WallTimeSeconds float64                  `json:"wall_time_seconds"`
+	Streams         map[string]*StreamReport `json:"streams"`
+	Keys            []KeyReport              `json:"keys"`
+}
+
+// StreamReport sums up the players of a stream.
+type StreamReport struct {
+	MatchesFound int                      `json:"matches_found,omitempty"`
+	Records      int                      `json:"records"`
+	Skipped      int                      `json:"skipped"`
+	Players      map[string]*PlayerReport `json:"players"`
+}
+
+// PlayerReport is what happened to one player of a stream. MatchesFound is
+// only set for the match streams, and Bookmark is the bookmark the player was
+// left with.
+type PlayerReport struct {
+	MatchesFound int          `json:"matches_found,omitempty"`
+	Records      int          `json:"records"`
+	Skipped      []SkipReport `json:"skipped,omitempty"`
+	Bookmark     *time.Time   `json:"bookmark,omitempty"`
+}
+
+// SkipReport is a skipped player, or match when MatchID is set.
+type SkipReport struct {
+	MatchID string `json:"match_id,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// KeyReport is how much an API key was used. Keys are identified by their
+// index in the config, never by the key itself.
+type KeyReport struct {
+	Index                int     `json:"index"`
+	Class                string  `json:"class"`
+	Quarantined          string  `json:"quarantined,omitempty"`
+	Requests             int64   `json:"requests"`
+	RateLimitWaitSeconds float64 `json:"rate_limit_wait_seconds"`
+}
+
+// reportStatus returns the status of a run that ended with err, matching the
+// exit codes of the tap.
+func reportStatus(err error) string {
+	var partial *PartialError
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case errors.As(err, &partial):
+		return StatusPartial
+	case errors.Is(err, context.Canceled):
+		return StatusInterrupted
+	default:
+		return StatusFailed
+	}
+}
+
+// player returns the report of a player, creating it if needed. r.mu must be
+// held.
+func (r *runSummary) player(stream, player string) *PlayerReport {
+	players := r.players[stream]
+	if players == nil {
+		players = make(map[string]*PlayerReport)
+		r.players[stream] = players
+	}
+	report := players[player]
+	if report == nil {
+		report = &PlayerReport{}
+		players[player] = report
+	}
+	return report
+}
+
+// found records the match ids listed for a player.
+func (r *runSummary) found(stream, player string, matches int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.player(stream, player).MatchesFound += matches
+}
+
+// emitted records a record written for a player.
+func (r *runSummary) emitted(stream, player string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.player(stream, player).Records++
+}
+
+// report builds the report of the run, which ended with err.
+func (r *syncRun) report(err error) *Report {
+	finished := time.Now()
+	report := &Report{
+		Status:          reportStatus(err),
+		StartedAt:       r.summary.started,
+		FinishedAt:      finished,
+		WallTimeSeconds: finished.Sub(r.summary.started).Seconds(),
+		Streams:         make(map[string]*StreamReport),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	r.summary.mu.Lock()
+	for _, skip := range r.summary.skipped {
+		player := r.summary.player(skip.Stream, skip.Player)
+		player.Skipped = append(player.Skipped, SkipReport{skip.MatchID, skip.Err.Error()})
+	}
+	for stream, players := range r.summary.players {
+		streamReport := &StreamReport{Players: players}
+		for _, player := range players {
+			streamReport.MatchesFound += player.MatchesFound
+			streamReport.Records += player.Records
+			streamReport.Skipped += len(player.Skipped)
+		}
+		report.Streams[stream] = streamReport
+	}
+	r.summary.mu.Unlock()
+
+	r.mu.Lock()
+	for stream, bookmarks := range r.state.Value {
+		for player, bookmark := range bookmarks {
+			if streamReport := report.Streams[stream]; streamReport != nil {
+				if playerReport := streamReport.Players[player]; playerReport != nil {
+					t := time.Unix(bookmark, 0).UTC()
+					playerReport.Bookmark = &t
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	r.pool.mu.Lock()
+	for i, riot := range r.pool.services {
+		key := KeyReport{Index: i, Class: string(keyUnknown)}
+		if service, ok := riot.(*RiotService); ok {
+			key.Class = string(service.class)
+			key.Requests = service.transport.requests.Load()
+			key.RateLimitWaitSeconds = time.Duration(service.transport.waited.Load()).Seconds()
+		}
+		if err := r.pool.quarantined[i]; err != nil {
+			key.Quarantined = err.Error()
+		}
+		report.Keys = append(report.Keys, key)
+	}
+	r.pool.mu.Unlock()
+
+	return report
+}
@@ -1,14 +1,18 @@
 package tap
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/KnutZuidema/golio"
+	"github.com/KnutZuidema/golio/api"
+	"github.com/KnutZuidema/golio/riot"
 	"github.com/KnutZuidema/golio/riot/account"
 	"github.com/KnutZuidema/golio/riot/lol"
+	"github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -17,100 +21,171 @@ import (
 const (
 	requestsPerWindow = 100
 	windowSeconds     = 120
-	sleepDuration     = time.Duration(float64(windowSeconds)/float64(requestsPerWindow)*1000+200) * time.Millisecond
+	requestInterval   = time.Duration(float64(windowSeconds)/float64(requestsPerWindow)*1000+200) * time.Millisecond
 )
 
+// matchIDPageSize is how many match ids are listed per request, the most the
+// API allows.
+const matchIDPageSize = 100
+
 type RiotService struct {
-	client *golio.Client
-	apiKey string
+	transport *transport
+	apiKey    string
+	keyIndex  int
+	region    api.Region
+	class     keyClass
+	limits    []rateLimit
+}
+
+func newRiotService(ctx context.Context, apiKey string, keyIndex int, region api.Region, metrics metricWriter, archive *archive, cache *responseCache) *RiotService {
+	t := &transport{
+		ctx:      ctx,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		limiter:  &rateLimiter{interval: requestInterval},
+		keyIndex: keyIndex,
+		metrics:  metrics,
+		archive:  archive,
+		cache:    cache,
+	}
+	return &RiotService{
+		transport: t,
+		apiKey:    apiKey,
+		keyIndex:  keyIndex,
+		region:    region,
+		class:     keyUnknown,
+	}
+}
+
+// client returns a golio Riot API client whose requests are bound to ctx.
+// golio takes no context, so a client is made per call, going through a
+// callTransport. golio.NewClient is not used as it would also fetch the Data
+// Dragon realms on every call.
+func (r *RiotService) client(ctx context.Context) *riot.Client {
+	return riot.NewClient(r.region, r.apiKey, callTransport{ctx, r.transport}, logrus.StandardLogger())
+}
+
+// callTransport binds the requests of a golio call to the context of the
+// call before handing them to the transport of the service.
+type callTransport struct {
+	ctx       context.Context
+	transport *transport
+}
+
+func (c callTransport) Do(r *http.Request) (*http.Response, error) {
+	return c.transport.Do(r.WithContext(c.ctx))
+}
+
+// route returns the regional routing value used by the account and match
+// endpoints, e.g. "europe" for euw1.
+func (r *RiotService) route() string {
+	return string(api.RegionToRoute[r.region])
+}
+
+// decodeError turns the json errors golio returns as is into a DecodeError.
+func (r *RiotService) decodeError(endpoint, region string, err error) error {
+	if _, ok := asAPIError(err); ok {
+		return err
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+		return err
+	}
+	return &DecodeError{
+		APIError: APIError{
+			StatusCode: http.StatusOK,
+			Endpoint:   endpoint,
+			Region:     region,
+			KeyIndex:   r.keyIndex,
+		},
+		Err: err,
+	}
 }
 
-func (r *RiotService) getMatchIdsByPlayer(player string, from time.Time, queueId int) ([]string, error) {
-	acc, err := r.getAccount(player)
+// ListMatchIDs lists a page of the ids of the matches of queueId, or of every
+// queue if zero, the player with the given puuid played between from and to.
+// It is a single request, so every page goes through the rate limiter of the
+// key.
+func (r *RiotService) ListMatchIDs(ctx context.Context, puuid string, from, to time.Time, queueId, start, count int) ([]string, error) {
+	query := url.Values{}
+	query.Set("startTime", strconv.FormatInt(from.Unix(), 10))
+	query.Set("endTime", strconv.FormatInt(to.Unix(), 10))
+	if queueId != 0 {
+		query.Set("queue", strconv.Itoa(queueId))
+	}
+	query.Set("start", strconv.Itoa(start))
+	query.Set("count", strconv.Itoa(count))
+	u := fmt.Sprintf("https://%s.api.riotgames.com/lol/match/v5/matches/by-puuid/%s/ids?%s",
+		r.route(), url.PathEscape(puuid), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return nil, err
-	}
-	res := r.client.Riot.LoL.Match.ListStream(acc.Puuid, &lol.MatchListOptions{
-		Queue:     &queueId,
-		StartTime: from,
-	})
-	time.Sleep(sleepDuration)
-	matchIds := make([]string, 0)
-	for match := range res {
-		matchIds = append(matchIds, match.MatchID)
-	}
-	return matchIds, nil
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Riot-Token", r.apiKey)
+
+	resp, err := r.transport.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list match ids: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var ids []string
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, fmt.Errorf("failed to list match ids: %w", r.decodeError(endpointMatchIDs, r.route(), err))
+	}
+	return ids, nil
 }
 
-func (r *RiotService) getAccount(player string) (*account.Account, error) {
+// GetAccount returns the account of a player given as gameName#tagLine.
+func (r *RiotService) GetAccount(ctx context.Context, player string) (*account.Account, error) {
 	parts := strings.Split(player, "#")
 	if len(parts) != 2 {
 		return nil, errors.New("Invalid player id: " + player)
 	}
-	acc, err := r.client.Riot.Account.GetByRiotID(parts[0], parts[1])
+	acc, err := r.client(ctx).Account.GetByRiotID(parts[0], parts[1])
 	if err != nil {
-		return nil, errors.New("Failed to get account: " + err.Error())
+		return nil, fmt.Errorf("failed to get account: %w", r.decodeError(endpointAccountByRiotID, r.route(), err))
 	}
-	time.Sleep(sleepDuration)
 	return acc, nil
 }
 
-func (r *RiotService) getMatchDetails(matchId string) (*lol.Match, error) {
-	match, err := r.client.Riot.LoL.Match.Get(matchId)
+func (r *RiotService) GetMatch(ctx context.Context, matchId string) (*lol.Match, error) {
+	match, err := r.client(ctx).LoL.Match.Get(matchId)
 	if err != nil {
-		return nil, err
+		return nil, r.decodeError(endpointMatch, r.route(), err)
 	}
-	time.Sleep(sleepDuration)
 	return match, nil
 }
 
-func (r *RiotService) getElo(player string) (*Elo, error) {
-	acc, err := r.getAccount(player)
+// GetLeagueEntries returns the ranked entries, one per queue, of the player
+// with the given puuid.
+func (r *RiotService) GetLeagueEntries(ctx context.Context, puuid string) ([]*lol.LeagueItem, error) {
+	res, err := r.client(ctx).LoL.League.ListByPuuid(puuid)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get league: %w", r.decodeError(endpointLeagueEntries, string(r.region), err))
 	}
-	res, err := r.client.Riot.LoL.League.ListByPuuid(acc.Puuid)
-	time.Sleep(sleepDuration)
-	if err != nil {
-		return nil, errors.New("Failed to get league: " + err.Error())
-	}
-	var elo Elo
-	for _, league := range res {
-		if league.QueueType == "RANKED_SOLO_5x5" {
-			elo = Elo{
-				Puuid:        acc.Puuid,
-				Date:         time.Now().Format("2006-01-02"),
-				LeaguePoints: league.LeaguePoints,
-				Tier:         league.Tier,
-				Rank:         league.Rank,
-			}
-		}
-	}
-	return &elo, nil
+	return res, nil
 }
 
-func (r *RiotService) getMatchTimeline(matchId string) (*MatchTimeline, error) {
-	url := fmt.Sprintf("https://europe.api.riotgames.com/lol/match/v5/matches/%s/timeline", matchId)
+// GetTimeline returns the timeline of a match, with the participant frames
+// keyed by puuid.
+func (r *RiotService) GetTimeline(ctx context.Context, matchId string) (*MatchTimeline, error) {
+	url := fmt.Sprintf("https://%s.api.riotgames.com/lol/match/v5/matches/%s/timeline", r.route(), matchId)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("X-Riot-Token", r.apiKey)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	time.Sleep(sleepDuration)
+	resp, err := r.transport.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status %d", resp.StatusCode)
-	}
-
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
@@ -138,7 +213,7 @@ func (r *RiotService) getMatchTimeline(matchId string) (*MatchTimeline, error) {
 
 	var timelineResp TimelineResponse
 	if err := json.Unmarshal(body, &timelineResp); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal timeline response: %w", err)
+		return nil, r.decodeError(endpointTimeline, r.route(), err)
 	}
 
 	participantMap := make(map[int]string)
@@ -0,0 +1,175 @@
+package tap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxTaskAttempts is how many times a task failing with a transient error is
+// tried before its player or match is skipped.
+const maxTaskAttempts = 3
+
+var errNoHealthyKeys = errors.New("no healthy API key left")
+
+// task is a unit of work of a workQueue. Tasks are not bound to an API key:
+// whichever worker is free runs it with its own RiotService.
+type task struct {
+	stream   string
+	player   string
+	matchID  string
+	attempts int
+	// run performs the task. It may push follow-up tasks to the queue.
+	run func(ctx context.Context, riot RiotAPI) error
+	// done is called once the task succeeded or was given up on, with the
+	// last error in the latter case. It is not called for tasks dropped
+	// because the sync was cancelled.
+	done func(err error)
+}
+
+// workQueue is the queue of tasks shared by the per-key workers of a stream.
+// A task counts as pending from the moment it is pushed until its done
+// callback returned, so tasks pushed by run or done keep the queue alive and
+// workers only exit once there is nothing left to do.
+type workQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   []*task
+	pending int
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *workQueue) push(t *task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, t)
+	q.pending++
+	queueDepth.WithLabelValues(t.stream).Inc()
+	q.cond.Signal()
+}
+
+// requeue puts back a task that is still pending so another worker picks it
+// up.
+func (q *workQueue) requeue(t *task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, t)
+	queueDepth.WithLabelValues(t.stream).Inc()
+	q.cond.Signal()
+}
+
+// pop blocks until a task is available. It returns false once every task is
+// done or ctx is cancelled.
+func (q *workQueue) pop(ctx context.Context) (*task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.tasks) == 0 && q.pending > 0 && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	if ctx.Err() != nil || len(q.tasks) == 0 {
+		return nil, false
+	}
+	t := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	queueDepth.WithLabelValues(t.stream).Dec()
+	return t, true
+}
+
+// finish marks a popped task as no longer pending.
+func (q *workQueue) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if q.pending == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+// wake unblocks every waiting worker so they notice a cancellation.
+func (q *workQueue) wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// stranded returns how many tasks were left in the queue.
+func (q *workQueue) stranded() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// isRetryable reports whether a task that failed with err may succeed when
+// tried again, possibly with another key. Network errors and timeouts of the
+// HTTP client are, as the run context is checked before.
+func isRetryable(err error) bool {
+	var rateLimited *RateLimitedError
+	var serverErr *ServerError
+	var netErr net.Error
+	return errors.As(err, &rateLimited) || errors.As(err, &serverErr) ||
+		errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// work runs the worker of a key: it pops and runs tasks with the RiotAPI of
+// the key until the queue is drained. A worker whose key gets rejected puts
+// its task back for the other workers and stops.
+func (r *syncRun) work(ctx context.Context, q *workQueue, key int) {
+	riot := r.pool.services[key]
+	for {
+		t, ok := q.pop(ctx)
+		if !ok {
+			return
+		}
+
+		err := t.run(ctx, riot)
+		switch {
+		case err == nil:
+			t.done(nil)
+		case ctx.Err() != nil:
+		case isFatal(err):
+			r.pool.quarantine(key, err)
+			r.logError("API key rejected, handing its tasks to the other keys", "key_index", key, "error", err)
+			q.requeue(t)
+			return
+		case isRetryable(err) && t.attempts+1 < maxTaskAttempts:
+			t.attempts++
+			taskRetriesTotal.WithLabelValues(t.stream).Inc()
+			r.logDebug("Retrying task", "stream", t.stream, "player", t.player, "match_id", t.matchID,
+				"key_index", key, "attempt", t.attempts, "error", err)
+			q.requeue(t)
+			continue
+		default:
+			t.done(err)
+		}
+		q.finish()
+	}
+}
+
+// runQueue runs one worker per healthy key until q is drained. It returns
+// errNoHealthyKeys if tasks were left because every key got rejected.
+func (r *syncRun) runQueue(ctx context.Context, q *workQueue) error {
+	stop := context.AfterFunc(ctx, q.wake)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for _, key := range r.pool.healthy() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx, q, key)
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() == nil && q.stranded() > 0 {
+		return errNoHealthyKeys
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/invopop/jsonschema"
 	"github.com/nmorvil/singer-tap-riot/pkg/singer"
 	"github.com/wk8/go-ordered-map/v2"
+	"time"
 )
 
 type Props = orderedmap.OrderedMap[string, *jsonschema.Schema]
@@ -91,14 +92,80 @@ func createAccountsStream() singer.Stream {
 	}
 }
 
+func createLaneDiffsStream() singer.Stream {
+	reflector := jsonschema.Reflector{
+		DoNotReference: true,
+	}
+	return singer.Stream{
+		TapStreamID: TimelineLaneDiffs,
+		Stream:      TimelineLaneDiffs,
+		Schema:      reflector.Reflect(new(LaneDiff)),
+		Metadata: []singer.StreamMetadata{
+			{
+				Breadcrumb: []string{},
+				Metadata: map[string]interface{}{
+					"inclusion":      "available",
+					"key-properties": []string{"matchId", "minute", "puuid"},
+				},
+			},
+		},
+	}
+}
+
+func createKillsStream() singer.Stream {
+	reflector := jsonschema.Reflector{
+		DoNotReference: true,
+	}
+	return singer.Stream{
+		TapStreamID: TimelineKills,
+		Stream:      TimelineKills,
+		Schema:      reflector.Reflect(new(Kill)),
+		Metadata: []singer.StreamMetadata{
+			{
+				Breadcrumb: []string{},
+				Metadata: map[string]interface{}{
+					"inclusion":      "available",
+					"key-properties": []string{"matchId", "eventIndex"},
+				},
+			},
+		},
+	}
+}
+
+// MatchWithID is a match with its id at the top level, and the epoch
+// millisecond timestamps of its info as date-times. The end of the game is
+// null for matches played before Riot started reporting it.
 type MatchWithID struct {
 	lol.Match
-	MatchID string `json:"matchId"`
+	MatchID       string     `json:"matchId"`
+	GameCreatedAt time.Time  `json:"gameCreatedAt"`
+	GameStartedAt *time.Time `json:"gameStartedAt"`
+	GameEndedAt   *time.Time `json:"gameEndedAt"`
+}
+
+func newMatchWithID(match *lol.Match) MatchWithID {
+	m := MatchWithID{Match: *match, MatchID: match.Metadata.MatchID}
+	if match.Info != nil {
+		m.GameCreatedAt = time.UnixMilli(match.Info.GameCreation).UTC()
+		m.GameStartedAt = epochMillis(match.Info.GameStartTimestamp)
+		m.GameEndedAt = epochMillis(match.Info.GameEndTimestamp)
+	}
+	return m
+}
+
+// epochMillis returns the time of an epoch millisecond timestamp, or nil if
+// it is not set.
+func epochMillis(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.UnixMilli(ms).UTC()
+	return &t
 }
 
 type Elo struct {
 	Puuid        string `json:"puuid"`
-	Date         string `json:"date"`
+	Date         string `json:"date" jsonschema:"format=date"`
 	LeaguePoints int    `json:"leaguePoints"`
 	Tier         string `json:"tier"`
 	Rank         string `json:"rank"`
@@ -151,6 +218,9 @@ type MatchEvent struct {
 	BeforeID                int                 `json:"beforeId"`
 	VictimDamageDealt       []DamageDealt       `json:"victimDamageDealt"`
 	VictimDamageReceived    []DamageDealt       `json:"victimDamageReceived"`
+	Bounty                  int                 `json:"bounty"`
+	ShutdownBounty          int                 `json:"shutdownBounty"`
+	KillStreakLength        int                 `json:"killStreakLength"`
 }
 
 type DamageDealt struct {
@@ -184,3 +254,50 @@ type Position struct {
 	X float64 `json:"x"`
 	Y float64 `json:"y"`
 }
+
+// LaneDiff is where a player of a match stood at a minute mark, and how far
+// ahead of their lane opponent they were. The diffs are null for a player
+// without an opponent, e.g. in modes without positions.
+type LaneDiff struct {
+	MatchID       string   `json:"matchId"`
+	Minute        int      `json:"minute"`
+	Puuid         string   `json:"puuid"`
+	TeamID        int      `json:"teamId"`
+	TeamPosition  string   `json:"teamPosition"`
+	ChampionName  string   `json:"championName"`
+	Gold          float64  `json:"gold"`
+	XP            float64  `json:"xp"`
+	CS            float64  `json:"cs"`
+	Damage        float64  `json:"damage"`
+	OpponentPuuid string   `json:"opponentPuuid,omitempty"`
+	GoldDiff      *float64 `json:"goldDiff"`
+	XPDiff        *float64 `json:"xpDiff"`
+	CSDiff        *float64 `json:"csDiff"`
+	DamageDiff    *float64 `json:"damageDiff"`
+}
+
+// Kill is a champion kill, elite monster kill or building kill of a match,
+// EventIndex being its index in the events of the timeline. Participants are
+// resolved to their puuid and champion, and the position to a map zone. The
+// flags are only set on champion kills.
+type Kill struct {
+	MatchID         string   `json:"matchId"`
+	EventIndex      int      `json:"eventIndex"`
+	Type            string   `json:"type"`
+	Timestamp       int      `json:"timestamp"`
+	KillerPuuid     string   `json:"killerPuuid,omitempty"`
+	KillerChampion  string   `json:"killerChampion,omitempty"`
+	KillerTeamID    int      `json:"killerTeamId,omitempty"`
+	VictimPuuid     string   `json:"victimPuuid,omitempty"`
+	VictimChampion  string   `json:"victimChampion,omitempty"`
+	AssistingPuuids []string `json:"assistingPuuids,omitempty"`
+	MonsterType     string   `json:"monsterType,omitempty"`
+	BuildingType    string   `json:"buildingType,omitempty"`
+	X               int      `json:"x"`
+	Y               int      `json:"y"`
+	Zone            string   `json:"zone"`
+	SoloKill        bool     `json:"soloKill"`
+	GankKill        bool     `json:"gankKill"`
+	Shutdown        bool     `json:"shutdown"`
+	ShutdownBounty  int      `json:"shutdownBounty"`
+}
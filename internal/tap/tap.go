@@ -1,35 +1,82 @@
 package tap
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"errors"
-	"fmt"
-	"github.com/KnutZuidema/golio"
 	"github.com/KnutZuidema/golio/api"
+	"github.com/KnutZuidema/golio/riot/lol"
 	"github.com/nmorvil/singer-tap-riot/pkg/singer"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	Matches        string = "matches"
-	MatchTimelines string = "match_timelines"
-	Elos           string = "elos"
-	Accounts       string = "accounts"
+	Matches           string = "matches"
+	MatchTimelines    string = "match_timelines"
+	Elos              string = "elos"
+	Accounts          string = "accounts"
+	TimelineLaneDiffs string = "timeline_lane_diffs"
+	TimelineKills     string = "timeline_kills"
 )
 
-// RiotServicePool manages multiple RiotService instances with different API keys
+// RiotServicePool is the set of RiotAPIs a sync spreads its requests over,
+// one per API key. Keys are identified by their index in services, which is
+// their index in the config.
 type RiotServicePool struct {
-	services []*RiotService
-	config   *Config
+	mu          sync.Mutex
+	services    []RiotAPI
+	quarantined map[int]error
+	config      *Config
 }
 
-// PlayerGroup represents a group of players assigned to a specific API key
-type PlayerGroup struct {
-	Players []string
-	Service *RiotService
+// syncRun holds what the streams of a RunSync call and their workers share.
+// Its methods are safe for concurrent use. The tap serializes messages itself;
+// mu guards the state, so that every STATE is a snapshot of whole bookmark
+// updates.
+type syncRun struct {
+	t       *singer.Tap
+	state   *singer.State
+	config  *Config
+	pool    *RiotServicePool
+	summary *runSummary
+	endTime time.Time
+	mu      sync.Mutex
+
+	puuidsMu sync.Mutex
+	puuids   map[string]*playerPuuid
+}
+
+// playerPuuid is the puuid of a player, resolved by the first task of the run
+// that needs it. mu is held while resolving it, so that concurrent tasks wait
+// for it instead of calling the API too.
+type playerPuuid struct {
+	mu    sync.Mutex
+	puuid string
+}
+
+// puuid returns the puuid of player, resolving it with riot the first time it
+// is needed in the run.
+func (r *syncRun) puuid(ctx context.Context, riot RiotAPI, player string) (string, error) {
+	r.puuidsMu.Lock()
+	p, ok := r.puuids[player]
+	if !ok {
+		p = &playerPuuid{}
+		r.puuids[player] = p
+	}
+	r.puuidsMu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.puuid == "" {
+		acc, err := riot.GetAccount(ctx, player)
+		if err != nil {
+			return "", err
+		}
+		p.puuid = acc.Puuid
+	}
+	return p.puuid, nil
 }
 
 func RunDiscovery(t *singer.Tap) error {
@@ -37,377 +84,873 @@ func RunDiscovery(t *singer.Tap) error {
 	return t.WriteCatalog(catalog)
 }
 
-func RunSync(t *singer.Tap, c *Config, cat *singer.Catalog, s *singer.State) error {
-	pool := createRiotServicePool(c)
-	playerGroups := pool.distributePlayersToServices(c.Players)
+// RunSync syncs the selected streams concurrently until they are all done or
+// until ctx is cancelled. On cancellation in-flight requests are aborted,
+// workers stop without advancing the bookmark of the player they were on, and
+// a final STATE is emitted.
+//
+// Every API key is checked before syncing and the ones Riot rejects are left
+// out. The work of each stream is queued as tasks that every key pulls from,
+// so a key rejected mid-run only drops out of the pool. Skipped players and
+// matches are reported as a *PartialError. Running out of healthy keys or a
+// stream going over its max_failures threshold aborts the run the same way a
+// cancellation does and is reported as a *FatalError.
+//
+// With c.CacheDir set, responses cached by earlier runs are reused instead
+// of requested again. With c.ReplayDir set, the responses come from an
+// archive instead of the API and no key is checked.
+//
+// The returned Report sums up the run. It is nil if the run could not start,
+// e.g. because of an invalid config.
+func RunSync(ctx context.Context, t *singer.Tap, c *Config, cat *singer.Catalog, s *singer.State) (*Report, error) {
+	var archive *archive
+	if c.ArchiveDir != "" {
+		var err error
+		archive, err = openArchive(c.ArchiveDir)
+		if err != nil {
+			return nil, err
+		}
+		defer archive.Close()
+	}
+	var cache *responseCache
+	if c.CacheDir != "" && c.ReplayDir == "" {
+		var err error
+		cache, err = openCache(c.CacheDir, c.cacheTTL())
+		if err != nil {
+			return nil, err
+		}
+		defer cache.Close()
+	}
+
+	return runSync(ctx, t, c, cat, s, func(ctx context.Context) ([]RiotAPI, error) {
+		if c.ReplayDir != "" {
+			return newReplayServices(ctx, c, t)
+		}
+		return newRiotServices(ctx, c, t, archive, cache), nil
+	})
+}
+
+// runSync is RunSync getting its RiotAPIs, one per key, from newAPIs, which
+// is given the context of the run.
+func runSync(ctx context.Context, t *singer.Tap, c *Config, cat *singer.Catalog, s *singer.State,
+	newAPIs func(context.Context) ([]RiotAPI, error)) (report *Report, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	endTime, err := c.endTime(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	validation, err := singer.ParseValidationMode(c.RecordValidation)
+	if err != nil {
+		return nil, err
+	}
+	t.SetValidation(validation)
+	laneDiffMinutes, err := c.laneDiffMinutes()
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := newAPIs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &syncRun{
+		t:       t,
+		state:   s,
+		config:  c,
+		pool:    newRiotServicePool(c, services),
+		summary: newRunSummary(c.MaxFailures, cancel),
+		endTime: endTime,
+		puuids:  make(map[string]*playerPuuid),
+	}
+	defer func() {
+		report = run.report(err)
+	}()
+
+	if c.ReplayDir == "" {
+		run.checkHealth(ctx)
+	}
+	if len(run.pool.healthy()) == 0 {
+		return nil, &FatalError{Err: errNoHealthyKeys}
+	}
+	defer run.logKeyHealth()
 
 	var selectedStreams []string
 	if cat == nil {
-		selectedStreams = []string{Matches, MatchTimelines, Elos, Accounts}
+		selectedStreams = []string{Matches, MatchTimelines, Elos, Accounts, TimelineLaneDiffs, TimelineKills}
 	} else {
 		selectedStreams = singer.GetSelectedStreams(cat)
 	}
 
+	syncs := map[string]func(context.Context) error{
+		Elos:     run.syncElos,
+		Accounts: run.syncAccounts,
+	}
+	// The selected match streams are synced together, so that every match is
+	// fetched once for all of them. They are emitted in this order, the ones
+	// needing only the match first.
+	matchStreams := []matchStream{matchesStream, matchTimelinesStream, laneDiffsStream(laneDiffMinutes), killsStream}
+	schemas := make(map[string]singer.Stream)
+	for _, stream := range CreateCatalog().Streams {
+		schemas[stream.Stream] = stream
+	}
+	selected := make(map[string]bool)
 	for _, stream := range selectedStreams {
-		switch stream {
-		case Matches:
-			t.Log("Starting sync of matches")
-			if err := syncMatchesConcurrent(t, playerGroups, s, c); err != nil {
-				return err
-			}
-		case MatchTimelines:
-			t.Log("Starting sync of match timelines")
-			if err := syncMatchTimelinesConcurrent(t, playerGroups, s, c); err != nil {
-				return err
-			}
-		case Elos:
-			t.Log("Starting sync of elos")
-			if err := syncElosConcurrent(t, playerGroups, s, c); err != nil {
-				return err
+		selected[stream] = true
+	}
+	var selectedMatchStreams []matchStream
+	var matchStreamNames []string
+	for _, stream := range matchStreams {
+		if selected[stream.name] {
+			selectedMatchStreams = append(selectedMatchStreams, stream)
+			matchStreamNames = append(matchStreamNames, stream.name)
+			// Left out of the check for unknown streams below.
+			delete(selected, stream.name)
+		}
+	}
+	var syncOrder []string
+	for _, stream := range selectedStreams {
+		if _, ok := syncs[stream]; ok {
+			syncOrder = append(syncOrder, stream)
+		} else if selected[stream] {
+			return nil, errors.New("Unknown stream: " + stream)
+		}
+	}
+	if len(selectedMatchStreams) > 0 {
+		name := strings.Join(matchStreamNames, ",")
+		syncs[name] = func(ctx context.Context) error {
+			return run.syncMatchStreams(ctx, selectedMatchStreams)
+		}
+		syncOrder = append(syncOrder, name)
+	}
+
+	// Every SCHEMA is queued before the streams start, so no RECORD of a
+	// stream can overtake its SCHEMA.
+	for _, stream := range selectedStreams {
+		t.WriteSchemaFromStream(schemas[stream])
+	}
+
+	// A broken output, e.g. the target exiting, aborts the run right away
+	// instead of burning API quota on records that go nowhere.
+	go func() {
+		select {
+		case <-t.Failed():
+			run.summary.abort(&FatalError{Err: t.Err()})
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, stream := range syncOrder {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.log("Starting sync", "stream", stream)
+			if err := syncs[stream](ctx); err != nil {
+				run.summary.abort(&FatalError{stream, err})
+				return
 			}
-		case Accounts:
-			t.Log("Starting sync of accounts")
-			if err := syncAccountsConcurrent(t, playerGroups, s, c); err != nil {
-				return err
+			if ctx.Err() == nil {
+				run.log("Finished sync", "stream", stream)
 			}
-		default:
-			return errors.New("Unknown stream: " + stream)
+		}()
+	}
+	wg.Wait()
+
+	for stream, count := range t.ValidationCounts() {
+		t.Log("Record validation", "stream", stream, "valid", count.Valid, "invalid", count.Invalid)
+	}
+
+	if err := ctx.Err(); err != nil {
+		t.Log("Sync interrupted, writing final state")
+		t.WriteState(s)
+		var fatal *FatalError
+		if errors.As(run.summary.err(), &fatal) {
+			return nil, fatal
 		}
+		return nil, err
 	}
-	return nil
+	return nil, run.summary.err()
 }
 
 func CreateCatalog() *singer.Catalog {
-	return &singer.Catalog{
-		Streams: []singer.Stream{createMatchesStream(), createMatchTimelineStream(), createEloStream(), createAccountsStream()},
+	catalog := &singer.Catalog{
+		Streams: []singer.Stream{createMatchesStream(), createMatchTimelineStream(), createEloStream(), createAccountsStream(),
+			createLaneDiffsStream(), createKillsStream()},
+	}
+	for _, stream := range catalog.Streams {
+		singer.NormalizeSchema(stream.Schema, stream.KeyProperties())
 	}
+	return catalog
 }
 
-func createRiotServicePool(c *Config) *RiotServicePool {
-	services := make([]*RiotService, len(c.APIKeys))
+// newRiotServices returns a RiotService per API key of c. They share the
+// archive and the cache, either of which may be nil.
+func newRiotServices(ctx context.Context, c *Config, metrics metricWriter, archive *archive, cache *responseCache) []RiotAPI {
+	services := make([]RiotAPI, len(c.APIKeys))
 	for i, apiKey := range c.APIKeys {
-		services[i] = &RiotService{
-			golio.NewClient(
-				apiKey,
-				golio.WithRegion(api.Region(c.Server)),
-			),
-			apiKey,
-		}
+		services[i] = newRiotService(ctx, apiKey, i, api.Region(c.Server), metrics, archive, cache)
 	}
+	return services
+}
+
+func newRiotServicePool(c *Config, services []RiotAPI) *RiotServicePool {
 	return &RiotServicePool{
-		services: services,
-		config:   c,
+		services:    services,
+		quarantined: make(map[int]error),
+		config:      c,
 	}
 }
 
-func (pool *RiotServicePool) distributePlayersToServices(players []string) []PlayerGroup {
-	groups := make([]PlayerGroup, len(pool.services))
-
-	for i := range groups {
-		groups[i] = PlayerGroup{
-			Players: make([]string, 0),
-			Service: pool.services[i],
+// healthy returns the keys that have not been rejected.
+func (pool *RiotServicePool) healthy() []int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	healthy := make([]int, 0, len(pool.services))
+	for key := range pool.services {
+		if _, ok := pool.quarantined[key]; !ok {
+			healthy = append(healthy, key)
 		}
 	}
+	return healthy
+}
 
-	for _, player := range players {
-		serviceIndex := hashPlayerToServiceIndex(player, len(pool.services))
-		groups[serviceIndex].Players = append(groups[serviceIndex].Players, player)
-	}
-
-	return groups
+// quarantine removes a key from the pool for the rest of the run.
+func (pool *RiotServicePool) quarantine(key int, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.quarantined[key] = err
+	quarantinedKeys.Set(float64(len(pool.quarantined)))
 }
 
-func hashPlayerToServiceIndex(player string, numServices int) int {
-	hasher := md5.New()
-	hasher.Write([]byte(player))
-	hash := hex.EncodeToString(hasher.Sum(nil))
+func (r *syncRun) log(msg string, args ...any) {
+	r.t.Log(msg, args...)
+}
 
-	hashStr := hash[:8]
-	hashInt64, err := strconv.ParseInt(hashStr, 16, 64)
-	if err != nil {
-		hashInt64 = 0
-		for _, char := range player {
-			hashInt64 = hashInt64*31 + int64(char)
-		}
-	}
+func (r *syncRun) logDebug(msg string, args ...any) {
+	r.t.LogDebug(msg, args...)
+}
 
-	return int(hashInt64) % numServices
+func (r *syncRun) logWarn(msg string, args ...any) {
+	r.t.LogWarn(msg, args...)
 }
 
-func syncAccountsConcurrent(t *singer.Tap, playerGroups []PlayerGroup, s *singer.State, c *Config) error {
-	t.WriteSchemaFromStream(createAccountsStream())
+func (r *syncRun) logError(msg string, args ...any) {
+	r.t.LogError(msg, args...)
+}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
+// writeRecord writes a record and counts it. It returns false, and no error,
+// for a record that record validation dropped.
+func (r *syncRun) writeRecord(stream string, record interface{}) (bool, error) {
+	err := r.t.WriteRecord(stream, record)
+	if errors.Is(err, singer.ErrDropped) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	recordsTotal.WithLabelValues(stream).Inc()
+	return true, nil
+}
 
-	for _, group := range playerGroups {
-		if len(group.Players) == 0 {
-			continue
-		}
+// skip logs and records a player or match that had to be left out.
+func (r *syncRun) skip(stream, player, matchId string, err error) {
+	args := []any{"stream", stream, "player", player}
+	if matchId != "" {
+		args = append(args, "match_id", matchId)
+	}
+	if apiErr, ok := asAPIError(err); ok {
+		args = append(args, "key_index", apiErr.KeyIndex, "status", apiErr.StatusCode)
+	}
+	r.logError("Skipping after failed sync", append(args, "error", err)...)
+	r.summary.skip(stream, player, matchId, err)
+}
 
-		wg.Add(1)
-		go func(players []string, service *RiotService) {
-			defer wg.Done()
+// fromTime returns where the sync of a player starts: its bookmark if it has
+// one, the configured start date otherwise.
+func (r *syncRun) fromTime(stream, player string) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bookmark, ok := r.state.Value[stream][player]; ok {
+		return time.Unix(bookmark, 0), nil
+	}
+	return startDateAsTime(r.config.StartDate)
+}
 
-			for _, player := range players {
-				acc, err := service.getAccount(player)
-				if err != nil {
-					mu.Lock()
-					t.LogError("Failed to get account for player: " + player + " - skipping")
-					mu.Unlock()
-					continue
-				}
+// setBookmark advances the bookmark of a player, clears its pagination
+// cursor and emits the new state. It does nothing once the output is broken,
+// since the records the bookmark covers may not have made it out.
+func (r *syncRun) setBookmark(stream, player string, t time.Time) {
+	r.setBookmarks([]string{stream}, player, t)
+}
 
-				mu.Lock()
-				t.WriteRecord(Accounts, acc)
-				mu.Unlock()
+// setBookmarks is setBookmark for several streams at once, emitting a single
+// state.
+func (r *syncRun) setBookmarks(streams []string, player string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.t.Err() != nil {
+		return
+	}
+	for _, stream := range streams {
+		r.setState(stream, player, t.Unix())
+		for _, key := range []string{pageEndKey(stream), pageStartKey(stream)} {
+			delete(r.state.Value[key], player)
+			if len(r.state.Value[key]) == 0 {
+				delete(r.state.Value, key)
 			}
-		}(group.Players, group.Service)
+		}
 	}
+	r.t.WriteState(r.state)
+}
 
-	wg.Wait()
-	t.WriteState(s)
-	return nil
+// pageEndKey is the entry of the state holding the end of the window whose
+// match ids the players of stream are being listed in.
+func pageEndKey(stream string) string {
+	return stream + "/page_end"
 }
 
-func syncElosConcurrent(t *singer.Tap, playerGroups []PlayerGroup, s *singer.State, c *Config) error {
-	t.WriteSchemaFromStream(createEloStream())
+// pageStartKey is the entry of the state holding the offset of the next page
+// of match ids of the players of stream.
+func pageStartKey(stream string) string {
+	return stream + "/page_start"
+}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	currentState := s
+// setPageCursor saves where the match id listing of a player is in the
+// window ending at end, for each of streams, and emits the new state, unless
+// the output is broken.
+//
+// Match ids are listed newest first and a window ends in the past, so its ids
+// only move by the matches that were still being played when it was first
+// listed, which end up in front: resuming at the saved offset can list a
+// match again, never skip one.
+func (r *syncRun) setPageCursor(streams []string, player string, end time.Time, start int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.t.Err() != nil {
+		return
+	}
+	for _, stream := range streams {
+		r.setState(pageEndKey(stream), player, end.Unix())
+		r.setState(pageStartKey(stream), player, int64(start))
+	}
+	r.t.WriteState(r.state)
+}
 
-	for _, group := range playerGroups {
-		if len(group.Players) == 0 {
-			continue
-		}
+// pageCursor returns the pagination cursor of a player, if it has one.
+func (r *syncRun) pageCursor(stream, player string) (time.Time, int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	end, ok := r.state.Value[pageEndKey(stream)][player]
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	start, ok := r.state.Value[pageStartKey(stream)][player]
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(end, 0), int(start), true
+}
 
-		wg.Add(1)
-		go func(players []string, service *RiotService) {
-			defer wg.Done()
+// setState sets a value of the state. r.mu must be held.
+func (r *syncRun) setState(key, player string, value int64) {
+	if r.state.Value[key] == nil {
+		r.state.Value[key] = make(map[string]int64)
+	}
+	r.state.Value[key][player] = value
+}
 
-			for _, player := range players {
-				mu.Lock()
-				var fromTime time.Time
-				var err error
-				stateValue, ok := currentState.Value[Elos][player]
-				if ok {
-					fromTime = time.Unix(stateValue, 0)
-				} else {
-					fromTime, err = startDateAsTime(c.StartDate)
-				}
-				mu.Unlock()
+func (r *syncRun) writeState() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.t.WriteState(r.state)
+}
 
+// syncAccounts syncs accounts as a full table: every run writes a new version
+// of the stream, activated once all the accounts were written, so targets
+// supporting ACTIVATE_VERSION drop accounts that are no longer configured.
+// An account skipped or dropped by record validation keeps the version from
+// being activated, as the target would delete its row.
+func (r *syncRun) syncAccounts(ctx context.Context) error {
+	version := time.Now().UnixMilli()
+	var dropped atomic.Int64
+	q := newWorkQueue()
+	for _, player := range r.config.Players {
+		q.push(&task{
+			stream: Accounts,
+			player: player,
+			run: func(ctx context.Context, riot RiotAPI) error {
+				acc, err := riot.GetAccount(ctx, player)
 				if err != nil {
-					mu.Lock()
-					t.LogError("Invalid start date: " + c.StartDate + " for player: " + player + " - skipping")
-					mu.Unlock()
-					continue
+					return err
 				}
-
-				if isToday(fromTime) {
-					mu.Lock()
-					t.Log(fmt.Sprintf("Already processed today for player %s, skipping", player))
-					mu.Unlock()
-					continue
+				err = r.t.WriteVersionedRecord(Accounts, version, acc)
+				if errors.Is(err, singer.ErrDropped) {
+					dropped.Add(1)
+					return nil
 				}
-
-				elo, err := service.getElo(player)
 				if err != nil {
-					mu.Lock()
-					t.LogError("Failed to get elo for player: " + player + " - skipping")
-					mu.Unlock()
-					continue
+					return err
 				}
-
-				mu.Lock()
-				t.WriteRecord(Elos, elo)
-				if currentState.Value[Elos] == nil {
-					currentState.Value[Elos] = make(map[string]int64)
+				recordsTotal.WithLabelValues(Accounts).Inc()
+				r.summary.emitted(Accounts, player)
+				return nil
+			},
+			done: func(err error) {
+				if err != nil {
+					r.skip(Accounts, player, "", err)
+					return
 				}
-				currentState.Value[Elos][player] = time.Now().Unix()
-				t.WriteState(currentState)
-				mu.Unlock()
-			}
-		}(group.Players, group.Service)
+				playersCompletedTotal.WithLabelValues(Accounts).Inc()
+			},
+		})
 	}
 
-	wg.Wait()
+	if err := r.runQueue(ctx, q); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	switch {
+	case r.summary.skips(Accounts) > 0:
+		r.logWarn("Some accounts were skipped, not activating the new version", "stream", Accounts, "version", version)
+	case dropped.Load() > 0:
+		r.logWarn("Some accounts were dropped, not activating the new version", "stream", Accounts, "version", version, "dropped", dropped.Load())
+	default:
+		r.t.WriteActivateVersion(Accounts, version)
+	}
+	r.writeState()
 	return nil
 }
 
-func syncMatchesConcurrent(t *singer.Tap, playerGroups []PlayerGroup, s *singer.State, c *Config) error {
-	t.WriteSchemaFromStream(createMatchesStream())
-
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	currentState := s
-
-	for groupIdx, group := range playerGroups {
-		if len(group.Players) == 0 {
+func (r *syncRun) syncElos(ctx context.Context) error {
+	q := newWorkQueue()
+	for _, player := range r.config.Players {
+		fromTime, err := r.fromTime(Elos, player)
+		if err != nil {
+			r.skip(Elos, player, "", err)
+			continue
+		}
+		if isToday(fromTime) {
+			r.log("Already synced today, skipping", "stream", Elos, "player", player)
 			continue
 		}
 
-		wg.Add(1)
-		go func(players []string, service *RiotService, gIdx int) {
-			defer wg.Done()
-
-			for playerIdx, player := range players {
-				mu.Lock()
-				t.Log(fmt.Sprintf("Group %d: Starting player %d/%d: %s", gIdx+1, playerIdx+1, len(players), player))
-
-				var fromTime time.Time
-				var err error
-				stateValue, ok := currentState.Value[Matches][player]
-				if ok {
-					fromTime = time.Unix(stateValue, 0)
-				} else {
-					fromTime, err = startDateAsTime(c.StartDate)
+		q.push(&task{
+			stream: Elos,
+			player: player,
+			run: func(ctx context.Context, riot RiotAPI) error {
+				puuid, err := r.puuid(ctx, riot, player)
+				if err != nil {
+					return err
 				}
-				mu.Unlock()
-
+				entries, err := riot.GetLeagueEntries(ctx, puuid)
 				if err != nil {
-					mu.Lock()
-					t.LogError("Invalid start date: " + c.StartDate + " for player: " + player + " - skipping")
-					mu.Unlock()
-					continue
+					return err
 				}
-
-				mu.Lock()
-				t.Log(fmt.Sprintf("Processing matches from %s for player %s", fromTime, player))
-				mu.Unlock()
-
-				ids, err := service.getMatchIdsByPlayer(player, fromTime, c.QueueId)
+				elo := soloQueueElo(puuid, entries, time.Now())
+				written, err := r.writeRecord(Elos, elo)
 				if err != nil {
-					mu.Lock()
-					t.LogError("Failed to get match ids for player: " + player + " - skipping")
-					mu.Unlock()
-					continue
+					return err
 				}
+				if written {
+					r.summary.emitted(Elos, player)
+				}
+				r.setBookmark(Elos, player, time.Now())
+				return nil
+			},
+			done: func(err error) {
+				if err != nil {
+					r.skip(Elos, player, "", err)
+					return
+				}
+				playersCompletedTotal.WithLabelValues(Elos).Inc()
+			},
+		})
+	}
 
-				mu.Lock()
-				t.Log(fmt.Sprintf("Found %d matches for player %s", len(ids), player))
-				mu.Unlock()
+	return r.runQueue(ctx, q)
+}
 
-				for i, id := range ids {
-					match, err := service.getMatchDetails(id)
-					if err != nil {
-						mu.Lock()
-						t.LogError("Failed to get match details for match id: " + id + " - skipping " + err.Error())
-						mu.Unlock()
-						continue
-					}
+// soloQueueElo returns the elo snapshot of a player on day now from their
+// league entries. Tier, rank and league points are left empty for a player
+// unranked in solo queue.
+func soloQueueElo(puuid string, entries []*lol.LeagueItem, now time.Time) *Elo {
+	elo := &Elo{
+		Puuid: puuid,
+		Date:  now.Format("2006-01-02"),
+	}
+	for _, league := range entries {
+		if league.QueueType == "RANKED_SOLO_5x5" {
+			elo.LeaguePoints = league.LeaguePoints
+			elo.Tier = league.Tier
+			elo.Rank = league.Rank
+		}
+	}
+	return elo
+}
 
-					mWithId := MatchWithID{*match, match.Metadata.MatchID}
-					mu.Lock()
-					t.WriteRecord(Matches, mWithId)
-					mu.Unlock()
+// matchStream is a stream with records derived from single matches: what it
+// needs fetched for a match, and how it turns that into records.
+type matchStream struct {
+	name          string
+	needsMatch    bool
+	needsTimeline bool
+	records       func(matchId string, match *lol.Match, timeline *MatchTimeline) []interface{}
+}
 
-					if (i+1)%50 == 0 {
-						mu.Lock()
-						t.Log(fmt.Sprintf("Progress: %d/%d matches processed for player %s", i+1, len(ids), player))
-						mu.Unlock()
-					}
-				}
+var matchesStream = matchStream{
+	name:       Matches,
+	needsMatch: true,
+	records: func(matchId string, match *lol.Match, timeline *MatchTimeline) []interface{} {
+		return []interface{}{newMatchWithID(match)}
+	},
+}
 
-				mu.Lock()
-				if currentState.Value[Matches] == nil {
-					currentState.Value[Matches] = make(map[string]int64)
+var matchTimelinesStream = matchStream{
+	name:          MatchTimelines,
+	needsTimeline: true,
+	records: func(matchId string, match *lol.Match, timeline *MatchTimeline) []interface{} {
+		return []interface{}{timeline}
+	},
+}
+
+func asRecords[T any](values []T) []interface{} {
+	records := make([]interface{}, len(values))
+	for i, v := range values {
+		records[i] = v
+	}
+	return records
+}
+
+// matchCursor is where the sync of a player in a match stream starts: its
+// bookmark, and its pagination cursor if it has a usable one.
+type matchCursor struct {
+	from      int64
+	pageEnd   int64
+	pageStart int
+}
+
+// syncMatchStreams syncs streams with records derived from single matches of
+// the players. The match ids of each player are listed window by window and
+// every match is queued as its own task, which fetches the match and its
+// timeline once for all the streams.
+//
+// The streams of a player are synced together when they start from the same
+// bookmark and pagination cursor, which they do unless one was selected
+// later or skipped the player. Streams starting elsewhere are synced on their
+// own and fetch the matches they share again, unless cache_dir is set.
+func (r *syncRun) syncMatchStreams(ctx context.Context, streams []matchStream) error {
+	q := newWorkQueue()
+	for _, player := range r.config.Players {
+		var jobs []*matchJob
+		var cursors []matchCursor
+	streams:
+		for _, stream := range streams {
+			fromTime, err := r.fromTime(stream.name, player)
+			if err != nil {
+				r.skip(stream.name, player, "", err)
+				continue
+			}
+			cursor := matchCursor{from: fromTime.Unix()}
+			if end, page, ok := r.pageCursor(stream.name, player); ok && end.After(fromTime) && !end.After(r.endTime) {
+				cursor.pageEnd, cursor.pageStart = end.Unix(), page
+			}
+			for i := range cursors {
+				if cursors[i] == cursor {
+					jobs[i].streams = append(jobs[i].streams, stream)
+					continue streams
 				}
-				currentState.Value[Matches][player] = time.Now().Unix()
-				t.WriteState(currentState)
-				mu.Unlock()
 			}
-		}(group.Players, group.Service, groupIdx)
+			cursors = append(cursors, cursor)
+			jobs = append(jobs, &matchJob{run: r, queue: q, streams: []matchStream{stream}, player: player})
+		}
+
+		for i, job := range jobs {
+			if job.plan(cursors[i]) {
+				q.push(job.listTask())
+			}
+		}
 	}
 
-	wg.Wait()
-	return nil
+	return r.runQueue(ctx, q)
 }
 
-func syncMatchTimelinesConcurrent(t *singer.Tap, playerGroups []PlayerGroup, s *singer.State, c *Config) error {
-	t.WriteSchemaFromStream(createMatchTimelineStream())
+// matchJob tracks the sync of one player of a set of match streams. Its
+// windows are processed one after the other, and the match ids of a window
+// page by page: the next page is listed once all the matches of the current
+// one are done. The pagination cursor is saved after each page and the
+// bookmark is moved to the end of a window once all of its pages are done, so
+// both only ever move forward. Both are kept per stream, and move together
+// for all the streams of the job.
+//
+// Once a match of a stream is skipped, the bookmark and cursor of that stream
+// are held where they are for the rest of the run, so that the next run lists
+// the skipped match again. Its later windows are still synced, and their
+// matches emitted again by the next run.
+type matchJob struct {
+	run     *syncRun
+	queue   *workQueue
+	streams []matchStream
+	// label names the streams of the job in logs and metrics.
+	label   string
+	player  string
+	windows []timeWindow
+	window  int
+	// start is the offset of the current page in the match ids of the
+	// window, and full whether it had as many ids as requested, in which
+	// case there may be more.
+	start int
+	full  bool
+
+	mu        sync.Mutex
+	total     int
+	remaining int
+	// held are the streams that skipped a match.
+	held map[string]bool
+}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	currentState := s
+// hold stops the bookmark and cursor of stream from moving for the rest of
+// the run.
+func (j *matchJob) hold(stream string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.held[stream] {
+		return
+	}
+	if j.held == nil {
+		j.held = make(map[string]bool)
+	}
+	j.held[stream] = true
+	j.run.logWarn("Holding the bookmark before the skipped match", "stream", stream, "player", j.player)
+}
 
-	for groupIdx, group := range playerGroups {
-		if len(group.Players) == 0 {
-			continue
+// advancing returns the streams of the job whose bookmark and cursor move.
+func (j *matchJob) advancing() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var names []string
+	for _, stream := range j.streams {
+		if !j.held[stream.name] {
+			names = append(names, stream.name)
 		}
+	}
+	return names
+}
 
-		wg.Add(1)
-		go func(players []string, service *RiotService, gIdx int) {
-			defer wg.Done()
+// plan sets up the windows of the job from where its streams start. It
+// returns false if there is nothing to sync.
+func (j *matchJob) plan(cursor matchCursor) bool {
+	r := j.run
+	j.label = strings.Join(j.streamNames(), ",")
+
+	fromTime := time.Unix(cursor.from, 0)
+	if cursor.pageEnd != 0 {
+		// The window that was interrupted goes on where it was left.
+		end := time.Unix(cursor.pageEnd, 0)
+		j.windows = append([]timeWindow{{fromTime, end}}, backfillWindows(end, r.endTime, r.config.backfillWindow())...)
+		j.start = cursor.pageStart
+		r.log("Resuming match id pagination", "stream", j.label, "player", j.player, "end", end, "start", j.start)
+	} else {
+		j.windows = backfillWindows(fromTime, r.endTime, r.config.backfillWindow())
+	}
+	if len(j.windows) == 0 {
+		r.log("Already synced up to the end date, skipping", "stream", j.label, "player", j.player, "end", r.endTime)
+		return false
+	}
+	r.log("Processing player", "stream", j.label, "player", j.player, "from", fromTime, "to", r.endTime)
+	return true
+}
+
+// listTask lists the current page of match ids of the current window and
+// queues them.
+func (j *matchJob) listTask() *task {
+	window := j.windows[j.window]
+	return &task{
+		stream: j.label,
+		player: j.player,
+		run: func(ctx context.Context, riot RiotAPI) error {
+			if len(j.windows) > 1 && j.start == 0 {
+				j.run.log("Processing window", "stream", j.label, "player", j.player,
+					"window", j.window+1, "windows", len(j.windows), "from", window.Start, "to", window.End)
+			}
+
+			puuid, err := j.run.puuid(ctx, riot, j.player)
+			if err != nil {
+				return err
+			}
+			ids, err := riot.ListMatchIDs(ctx, puuid, window.Start, window.End, j.run.config.QueueId, j.start, matchIDPageSize)
+			if err != nil {
+				return err
+			}
+			j.run.log("Listed matches", "stream", j.label, "player", j.player, "start", j.start, "matches", len(ids))
+
+			for _, stream := range j.streams {
+				j.run.summary.found(stream.name, j.player, len(ids))
+			}
+
+			j.mu.Lock()
+			j.full = len(ids) >= matchIDPageSize
+			j.total += len(ids)
+			j.remaining = len(ids)
+			j.mu.Unlock()
 
-			for playerIdx, player := range players {
-				mu.Lock()
-				t.Log(fmt.Sprintf("Group %d: Starting player %d/%d: %s", gIdx+1, playerIdx+1, len(players), player))
-
-				var fromTime time.Time
-				var err error
-				stateValue, ok := currentState.Value[MatchTimelines][player]
-				if ok {
-					fromTime = time.Unix(stateValue, 0)
-				} else {
-					fromTime, err = startDateAsTime(c.StartDate)
+			if len(ids) == 0 {
+				j.pageDone()
+			}
+			for _, id := range ids {
+				j.queue.push(j.matchTask(id))
+			}
+			return nil
+		},
+		done: func(err error) {
+			if err != nil {
+				for _, stream := range j.streams {
+					j.run.skip(stream.name, j.player, "", err)
 				}
-				mu.Unlock()
+			}
+		},
+	}
+}
 
-				if err != nil {
-					mu.Lock()
-					t.LogError("Invalid start date: " + c.StartDate + " for player: " + player + " - skipping")
-					mu.Unlock()
-					continue
+// matchTask fetches a match and emits its records to the streams of the job,
+// in order. The match and its timeline are each fetched once, independently,
+// and are kept across the attempts of the task along with the streams already
+// emitted, so a retry only fetches and emits what is left. A failed fetch only
+// skips the streams that need it: matches is still emitted without a
+// timeline, and match_timelines without a match.
+func (j *matchJob) matchTask(matchId string) *task {
+	var match *lol.Match
+	var timeline *MatchTimeline
+	var matchErr, timelineErr error
+	emitted := make(map[string]bool)
+	// fetchErr returns why stream cannot be emitted, if it cannot.
+	fetchErr := func(stream matchStream) error {
+		if stream.needsMatch && match == nil {
+			return matchErr
+		}
+		if stream.needsTimeline && timeline == nil {
+			return timelineErr
+		}
+		return nil
+	}
+	return &task{
+		stream:  j.label,
+		player:  j.player,
+		matchID: matchId,
+		run: func(ctx context.Context, riot RiotAPI) error {
+			var needsMatch, needsTimeline bool
+			for _, stream := range j.streams {
+				if !emitted[stream.name] {
+					needsMatch = needsMatch || stream.needsMatch
+					needsTimeline = needsTimeline || stream.needsTimeline
 				}
+			}
+			if needsMatch && match == nil {
+				match, matchErr = riot.GetMatch(ctx, matchId)
+			}
+			if needsTimeline && timeline == nil {
+				timeline, timelineErr = riot.GetTimeline(ctx, matchId)
+			}
 
-				ids, err := service.getMatchIdsByPlayer(player, fromTime, c.QueueId)
-				if err != nil {
-					mu.Lock()
-					t.LogError("Failed to get match ids for player: " + player + " - skipping")
-					mu.Unlock()
+			for _, stream := range j.streams {
+				if emitted[stream.name] || fetchErr(stream) != nil {
 					continue
 				}
-
-				mu.Lock()
-				t.Log(fmt.Sprintf("Found %d matches for player %s", len(ids), player))
-				mu.Unlock()
-
-				for i, id := range ids {
-					timeline, err := service.getMatchTimeline(id)
+				for _, record := range stream.records(matchId, match, timeline) {
+					written, err := j.run.writeRecord(stream.name, record)
 					if err != nil {
-						mu.Lock()
-						t.LogError("Failed to get match details for match id: " + id + " - skipping : " + err.Error())
-						mu.Unlock()
-						continue
+						return err
 					}
-
-					mu.Lock()
-					t.WriteRecord(MatchTimelines, timeline)
-					mu.Unlock()
-
-					if (i+1)%50 == 0 {
-						mu.Lock()
-						t.Log(fmt.Sprintf("Progress: %d/%d matches processed for player %s", i+1, len(ids), player))
-						mu.Unlock()
+					if written {
+						j.run.summary.emitted(stream.name, j.player)
 					}
 				}
-
-				mu.Lock()
-				if currentState.Value[MatchTimelines] == nil {
-					currentState.Value[MatchTimelines] = make(map[string]int64)
+				emitted[stream.name] = true
+			}
+			// Joined, so the task is retried if either fetch may succeed
+			// when tried again.
+			return errors.Join(matchErr, timelineErr)
+		},
+		done: func(err error) {
+			if err != nil {
+				for _, stream := range j.streams {
+					if emitted[stream.name] {
+						continue
+					}
+					streamErr := fetchErr(stream)
+					if streamErr == nil {
+						streamErr = err
+					}
+					j.run.skip(stream.name, j.player, matchId, streamErr)
+					j.hold(stream.name)
 				}
-				currentState.Value[MatchTimelines][player] = time.Now().Unix()
-				t.WriteState(currentState)
-				mu.Unlock()
 			}
-		}(group.Players, group.Service, groupIdx)
+			j.matchDone()
+		},
 	}
+}
 
-	wg.Wait()
-	return nil
+func (j *matchJob) matchDone() {
+	j.mu.Lock()
+	j.remaining--
+	processed, total, remaining := j.total-j.remaining, j.total, j.remaining
+	j.mu.Unlock()
+
+	if processed%50 == 0 {
+		j.run.log("Progress", "stream", j.label, "player", j.player, "processed", processed, "total", total)
+	}
+	if remaining == 0 {
+		j.pageDone()
+	}
+}
+
+// pageDone saves the pagination cursor and queues the listing of the next
+// page of the current window, or ends the window if it was the last page.
+func (j *matchJob) pageDone() {
+	j.mu.Lock()
+	full := j.full
+	j.mu.Unlock()
+	if !full {
+		j.windowDone()
+		return
+	}
+	j.start += matchIDPageSize
+	if streams := j.advancing(); len(streams) > 0 {
+		j.run.setPageCursor(streams, j.player, j.windows[j.window].End, j.start)
+	}
+	j.queue.push(j.listTask())
+}
+
+// windowDone moves the bookmark to the end of the current window and queues
+// the listing of the next one.
+func (j *matchJob) windowDone() {
+	if streams := j.advancing(); len(streams) > 0 {
+		j.run.setBookmarks(streams, j.player, j.windows[j.window].End)
+	}
+	j.start = 0
+	j.mu.Lock()
+	j.total = 0
+	j.mu.Unlock()
+	j.window++
+	if j.window < len(j.windows) {
+		j.queue.push(j.listTask())
+		return
+	}
+	for _, stream := range j.streams {
+		playersCompletedTotal.WithLabelValues(stream.name).Inc()
+	}
+}
+
+func (j *matchJob) streamNames() []string {
+	names := make([]string, len(j.streams))
+	for i, stream := range j.streams {
+		names[i] = stream.name
+	}
+	return names
 }
 
 func startDateAsTime(s string) (time.Time, error) {
@@ -0,0 +1,1333 @@
+package tap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KnutZuidema/golio/riot/account"
+	"github.com/KnutZuidema/golio/riot/lol"
+	"github.com/invopop/jsonschema"
+	"github.com/nmorvil/singer-tap-riot/pkg/singer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRiot is an in-memory RiotAPI. Calls are named after the method and its
+// argument, e.g. "GetMatch EUW1_1", to script failures and count calls.
+type fakeRiot struct {
+	mu       sync.Mutex
+	accounts map[string]string
+	matches  map[string][]fakeMatch
+	leagues  map[string][]*lol.LeagueItem
+	failures map[string][]error
+	calls    map[string]int
+	// onCall, if set, is called before every call and may fail it.
+	onCall func(ctx context.Context, call string) error
+}
+
+type fakeMatch struct {
+	id      string
+	puuid   string
+	created time.Time
+}
+
+// fakeOpponent is the puuid of the lane opponent of the players in every
+// fake match.
+const fakeOpponent = "opponent"
+
+// fakeGameMinutes is how long every fake match lasts.
+const fakeGameMinutes = 12
+
+func newFakeRiot() *fakeRiot {
+	return &fakeRiot{
+		accounts: make(map[string]string),
+		matches:  make(map[string][]fakeMatch),
+		leagues:  make(map[string][]*lol.LeagueItem),
+		failures: make(map[string][]error),
+		calls:    make(map[string]int),
+	}
+}
+
+// addPlayer adds a player, its puuid being the player name, with matches
+// created at the given times, oldest first, and ranked GOLD II in solo queue.
+func (f *fakeRiot) addPlayer(player string, created ...time.Time) {
+	f.accounts[player] = player
+	for i, t := range created {
+		id := fmt.Sprintf("EUW1_%s_%d", strings.Split(player, "#")[0], i+1)
+		f.matches[player] = append(f.matches[player], fakeMatch{id, player, t})
+	}
+	f.leagues[player] = []*lol.LeagueItem{
+		{QueueType: "RANKED_FLEX_SR", Tier: "SILVER", Rank: "I"},
+		{QueueType: "RANKED_SOLO_5x5", Tier: "GOLD", Rank: "II", LeaguePoints: 42},
+	}
+}
+
+// fail makes the next calls named call fail with errs, one error per call.
+func (f *fakeRiot) fail(call string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[call] = append(f.failures[call], errs...)
+}
+
+func (f *fakeRiot) call(ctx context.Context, call string) error {
+	if f.onCall != nil {
+		if err := f.onCall(ctx, call); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[call]++
+	if errs := f.failures[call]; len(errs) > 0 {
+		f.failures[call] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (f *fakeRiot) callCount(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[call]
+}
+
+func (f *fakeRiot) GetAccount(ctx context.Context, player string) (*account.Account, error) {
+	if err := f.call(ctx, "GetAccount "+player); err != nil {
+		return nil, err
+	}
+	puuid, ok := f.accounts[player]
+	if !ok {
+		return nil, &NotFoundError{APIError{StatusCode: http.StatusNotFound, Endpoint: endpointAccountByRiotID}}
+	}
+	return &account.Account{Puuid: puuid, GameName: strings.Split(player, "#")[0]}, nil
+}
+
+func (f *fakeRiot) ListMatchIDs(ctx context.Context, puuid string, from, to time.Time, queueId, start, count int) ([]string, error) {
+	if err := f.call(ctx, "ListMatchIDs "+puuid); err != nil {
+		return nil, err
+	}
+	var ids []string
+	// Newest first, like the API.
+	matches := f.matches[puuid]
+	for i := len(matches) - 1; i >= 0; i-- {
+		if !matches[i].created.Before(from) && matches[i].created.Before(to) {
+			ids = append(ids, matches[i].id)
+		}
+	}
+	if start >= len(ids) {
+		return nil, nil
+	}
+	return ids[start:min(start+count, len(ids))], nil
+}
+
+func (f *fakeRiot) findMatch(matchId string) (fakeMatch, bool) {
+	for _, matches := range f.matches {
+		for _, match := range matches {
+			if match.id == matchId {
+				return match, true
+			}
+		}
+	}
+	return fakeMatch{}, false
+}
+
+func (f *fakeRiot) GetMatch(ctx context.Context, matchId string) (*lol.Match, error) {
+	if err := f.call(ctx, "GetMatch "+matchId); err != nil {
+		return nil, err
+	}
+	match, ok := f.findMatch(matchId)
+	if !ok {
+		return nil, &NotFoundError{APIError{StatusCode: http.StatusNotFound, Endpoint: endpointMatch}}
+	}
+	return &lol.Match{
+		Metadata: &lol.MatchMetadata{MatchID: matchId},
+		Info: &lol.MatchInfo{
+			GameCreation: match.created.UnixMilli(),
+			Participants: []*lol.Participant{
+				{ParticipantID: 1, PUUID: match.puuid, TeamID: 100, TeamPosition: "TOP", ChampionName: "Garen"},
+				{ParticipantID: 6, PUUID: fakeOpponent, TeamID: 200, TeamPosition: "TOP", ChampionName: "Darius"},
+			},
+		},
+	}, nil
+}
+
+func (f *fakeRiot) GetTimeline(ctx context.Context, matchId string) (*MatchTimeline, error) {
+	if err := f.call(ctx, "GetTimeline "+matchId); err != nil {
+		return nil, err
+	}
+	match, ok := f.findMatch(matchId)
+	if !ok {
+		return nil, &NotFoundError{APIError{StatusCode: http.StatusNotFound, Endpoint: endpointTimeline}}
+	}
+	// The player earns 100 gold a minute, their opponent 90.
+	var frames []MatchFrame
+	for minute := 0; minute <= fakeGameMinutes; minute++ {
+		timestamp := float64(minute*60000 + 20)
+		frames = append(frames,
+			MatchFrame{PlayerID: match.puuid, Timestamp: timestamp, TotalGold: float64(500 + 100*minute), MinionsKilled: float64(8 * minute)},
+			MatchFrame{PlayerID: fakeOpponent, Timestamp: timestamp, TotalGold: float64(500 + 90*minute), MinionsKilled: float64(7 * minute)})
+	}
+	// The player solo kills their opponent in top lane at 6 minutes.
+	killType := lol.MatchEventTypeChampionKill
+	events := []MatchEvent{
+		{Type: &killType, Timestamp: 360000, KillerID: 1, VictimID: 6, Position: &lol.MatchPosition{X: 1200, Y: 9000}},
+	}
+	return &MatchTimeline{
+		Frames:  frames,
+		Events:  events,
+		MatchId: matchId,
+	}, nil
+}
+
+func (f *fakeRiot) GetLeagueEntries(ctx context.Context, puuid string) ([]*lol.LeagueItem, error) {
+	if err := f.call(ctx, "GetLeagueEntries "+puuid); err != nil {
+		return nil, err
+	}
+	return f.leagues[puuid], nil
+}
+
+// quietLogger drops logs and metrics.
+type quietLogger struct{}
+
+func (quietLogger) Debug(msg string, args ...any) {}
+func (quietLogger) Info(msg string, args ...any)  {}
+func (quietLogger) Warn(msg string, args ...any)  {}
+func (quietLogger) Error(msg string, args ...any) {}
+func (quietLogger) Metric(m singer.Metric)        {}
+
+// output is the decoded output of a sync.
+type output struct {
+	messages []map[string]interface{}
+}
+
+func (o *output) ofType(typ string) []map[string]interface{} {
+	var messages []map[string]interface{}
+	for _, msg := range o.messages {
+		if msg["type"] == typ {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (o *output) records(stream string) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, msg := range o.ofType("RECORD") {
+		if msg["stream"] == stream {
+			records = append(records, msg["record"].(map[string]interface{}))
+		}
+	}
+	return records
+}
+
+// lastState returns the bookmarks of the last STATE.
+func (o *output) lastState() map[string]interface{} {
+	states := o.ofType("STATE")
+	if len(states) == 0 {
+		return nil
+	}
+	return states[len(states)-1]["value"].(map[string]interface{})
+}
+
+// state returns the last STATE, to resume from in another run.
+func (o *output) state() *singer.State {
+	state := &singer.State{Value: make(map[string]map[string]int64)}
+	for key, values := range o.lastState() {
+		state.Value[key] = make(map[string]int64)
+		for player, value := range values.(map[string]interface{}) {
+			state.Value[key][player] = int64(value.(float64))
+		}
+	}
+	return state
+}
+
+func (o *output) bookmark(stream, player string) (time.Time, bool) {
+	bookmarks, ok := o.lastState()[stream].(map[string]interface{})
+	if !ok {
+		return time.Time{}, false
+	}
+	bookmark, ok := bookmarks[player].(float64)
+	return time.Unix(int64(bookmark), 0), ok
+}
+
+func testConfig(players ...string) *Config {
+	return &Config{
+		Server:    "euw1",
+		Players:   players,
+		StartDate: "2024-01-01",
+		EndDate:   "2024-02-29",
+	}
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// runTestSync runs a sync with the given fakes, one per key, writing to w.
+func runTestSync(ctx context.Context, t *testing.T, w io.Writer, c *Config, cat *singer.Catalog, state *singer.State, fakes ...RiotAPI) (*Report, error) {
+	t.Helper()
+	tap := singer.NewTapWithWriter(w)
+	tap.SetLogger(quietLogger{})
+	if state == nil {
+		state = &singer.State{Value: make(map[string]map[string]int64)}
+	}
+	report, err := runSync(ctx, tap, c, cat, state, func(context.Context) ([]RiotAPI, error) {
+		return fakes, nil
+	})
+	tap.Close()
+	return report, err
+}
+
+func decodeOutput(t *testing.T, b []byte) *output {
+	t.Helper()
+	o := &output{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	for decoder.More() {
+		var msg map[string]interface{}
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatalf("invalid output: %s", err)
+		}
+		o.messages = append(o.messages, msg)
+	}
+	return o
+}
+
+func syncWith(t *testing.T, c *Config, cat *singer.Catalog, state *singer.State, fakes ...RiotAPI) (*output, *Report, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	report, err := runTestSync(context.Background(), t, &buf, c, cat, state, fakes...)
+	return decodeOutput(t, buf.Bytes()), report, err
+}
+
+func selectStreams(streams ...string) *singer.Catalog {
+	catalog := CreateCatalog()
+	for i := range catalog.Streams {
+		for _, stream := range streams {
+			if catalog.Streams[i].Stream == stream {
+				catalog.Streams[i].Metadata[0].Metadata["selected"] = true
+			}
+		}
+	}
+	return catalog
+}
+
+func matchIDs(records []map[string]interface{}) []string {
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record["matchId"].(string))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRunSyncEmitsAllStreams(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"), date("2024-03-10"))
+
+	out, report, err := syncWith(t, testConfig("alice#euw"), nil, nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+
+	// Every SCHEMA comes before the first RECORD of its stream.
+	schemas := make(map[string]bool)
+	for _, msg := range out.messages {
+		stream, _ := msg["stream"].(string)
+		switch msg["type"] {
+		case "SCHEMA":
+			schemas[stream] = true
+		case "RECORD":
+			if !schemas[stream] {
+				t.Fatalf("RECORD of %s before its SCHEMA", stream)
+			}
+		}
+	}
+	if len(schemas) != 6 {
+		t.Errorf("got SCHEMAs for %v, want the 6 streams", schemas)
+	}
+
+	want := []string{"EUW1_alice_1", "EUW1_alice_2"}
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("matches = %v, want %v", got, want)
+	}
+	if got := matchIDs(out.records(MatchTimelines)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("timelines = %v, want %v", got, want)
+	}
+	for _, match := range out.records(Matches) {
+		if match["matchId"] == "EUW1_alice_1" && (match["gameCreatedAt"] != "2024-01-10T00:00:00Z" || match["gameEndedAt"] != nil) {
+			t.Errorf("match dates = %v, %v, want the creation date and no end", match["gameCreatedAt"], match["gameEndedAt"])
+		}
+	}
+
+	elos := out.records(Elos)
+	if len(elos) != 1 || elos[0]["tier"] != "GOLD" || elos[0]["rank"] != "II" || elos[0]["leaguePoints"] != 42.0 {
+		t.Errorf("elos = %v, want the solo queue entry", elos)
+	}
+	if accounts := out.records(Accounts); len(accounts) != 1 || accounts[0]["puuid"] != "alice#euw" {
+		t.Errorf("accounts = %v", accounts)
+	}
+	// Minutes 5 and 10 for both players of both matches, the games ending
+	// before 15.
+	if got := len(out.records(TimelineLaneDiffs)); got != 8 {
+		t.Errorf("got %d lane diffs, want 8", got)
+	}
+	if kills := out.records(TimelineKills); len(kills) != 2 || kills[0]["victimChampion"] != "Darius" {
+		t.Errorf("kills = %v, want the kill of each match", kills)
+	}
+	// Once for the accounts stream, once for the puuid every other stream
+	// shares.
+	if got := fake.callCount("GetAccount alice#euw"); got != 2 {
+		t.Errorf("got the account %d times, want 2", got)
+	}
+	if activations := out.ofType("ACTIVATE_VERSION"); len(activations) != 1 {
+		t.Errorf("got %d ACTIVATE_VERSION, want 1", len(activations))
+	}
+
+	for _, stream := range []string{Matches, MatchTimelines} {
+		if bookmark, ok := out.bookmark(stream, "alice#euw"); !ok || !bookmark.Equal(date("2024-03-01")) {
+			t.Errorf("%s bookmark = %v, want the end date", stream, bookmark)
+		}
+	}
+
+	if report.Status != StatusSucceeded {
+		t.Errorf("report status = %s", report.Status)
+	}
+	if got := report.Streams[Matches].Players["alice#euw"].MatchesFound; got != 2 {
+		t.Errorf("report matches found = %d, want 2", got)
+	}
+}
+
+func TestRunSyncRejectsEndDateBeforeStartDate(t *testing.T) {
+	fake := newFakeRiot()
+	c := testConfig("alice#euw")
+	c.EndDate = "2023-01-01"
+
+	_, report, err := syncWith(t, c, nil, nil, fake)
+
+	if err == nil || !strings.Contains(err.Error(), "before start date") {
+		t.Fatalf("err = %v, want an invalid end date", err)
+	}
+	if report != nil {
+		t.Errorf("report = %+v, want none for a run that could not start", report)
+	}
+}
+
+func TestRunSyncResumesFromBookmark(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	state := &singer.State{Value: map[string]map[string]int64{
+		Matches: {"alice#euw": date("2024-02-01").Unix()},
+	}}
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), state, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != "[EUW1_alice_2]" {
+		t.Errorf("matches = %v, want only the match after the bookmark", got)
+	}
+}
+
+func TestRunSyncOnlySelectedStreams(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Elos), nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	for _, msg := range out.messages {
+		if stream, ok := msg["stream"]; ok && stream != Elos {
+			t.Errorf("got a %s message for %s", msg["type"], stream)
+		}
+	}
+	if fake.callCount("ListMatchIDs alice#euw") != 0 {
+		t.Error("match ids listed for an unselected stream")
+	}
+}
+
+func TestRunSyncCheckpointsBackfillWindows(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	c := testConfig("alice#euw")
+	c.BackfillWindowDays = 20
+
+	out, _, err := syncWith(t, c, selectStreams(Matches), nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+
+	// 2024-01-01 to 2024-02-29 included is 60 days, so 3 windows.
+	if got := fake.callCount("ListMatchIDs alice#euw"); got != 3 {
+		t.Errorf("listed match ids %d times, want once per window", got)
+	}
+	var bookmarks []int64
+	for _, state := range out.ofType("STATE") {
+		value := state["value"].(map[string]interface{})
+		if matches, ok := value[Matches].(map[string]interface{}); ok {
+			bookmarks = append(bookmarks, int64(matches["alice#euw"].(float64)))
+		}
+	}
+	want := []int64{date("2024-01-21").Unix(), date("2024-02-10").Unix(), date("2024-03-01").Unix()}
+	if fmt.Sprint(bookmarks) != fmt.Sprint(want) {
+		t.Errorf("bookmarks = %v, want the end of each window %v", bookmarks, want)
+	}
+}
+
+// manyMatches returns n match creation times a minute apart, from start.
+func manyMatches(start time.Time, n int) []time.Time {
+	created := make([]time.Time, n)
+	for i := range created {
+		created[i] = start.Add(time.Duration(i) * time.Minute)
+	}
+	return created
+}
+
+func TestRunSyncPagesMatchIDs(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", manyMatches(date("2024-01-10"), 2*matchIDPageSize)...)
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := len(out.records(Matches)); got != 2*matchIDPageSize {
+		t.Errorf("got %d matches, want %d", got, 2*matchIDPageSize)
+	}
+	// Two full pages, then an empty one.
+	if got := fake.callCount("ListMatchIDs alice#euw"); got != 3 {
+		t.Errorf("listed %d pages, want 3", got)
+	}
+	if got := fake.callCount("GetAccount alice#euw"); got != 1 {
+		t.Errorf("got the account %d times, want once for all the pages", got)
+	}
+	state := out.lastState()
+	if _, ok := state[pageStartKey(Matches)]; ok {
+		t.Errorf("pagination cursor left in the final state %v", state)
+	}
+}
+
+func TestRunSyncResumesPagination(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", manyMatches(date("2024-01-10"), 2*matchIDPageSize+10)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lists := 0
+	fake.onCall = func(ctx context.Context, call string) error {
+		if call == "ListMatchIDs alice#euw" {
+			if lists++; lists == 3 {
+				cancel()
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	_, err := runTestSync(ctx, t, &buf, testConfig("alice#euw"), selectStreams(Matches), nil, fake)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	first := decodeOutput(t, buf.Bytes())
+	if got := len(first.records(Matches)); got != 2*matchIDPageSize {
+		t.Fatalf("got %d matches before the interruption, want %d", got, 2*matchIDPageSize)
+	}
+
+	// Rerun from the final state of the interrupted run.
+	state := first.state()
+	fake.onCall = nil
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), state, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	want := []string{"EUW1_alice_1", "EUW1_alice_10", "EUW1_alice_2", "EUW1_alice_3", "EUW1_alice_4",
+		"EUW1_alice_5", "EUW1_alice_6", "EUW1_alice_7", "EUW1_alice_8", "EUW1_alice_9"}
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("matches = %v, want the %d oldest", got, len(want))
+	}
+	if bookmark, ok := out.bookmark(Matches, "alice#euw"); !ok || !bookmark.Equal(date("2024-03-01")) {
+		t.Errorf("bookmark = %v, want the end date", bookmark)
+	}
+}
+
+func TestRunSyncFetchesEachMatchOnce(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), nil, nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	for _, id := range []string{"EUW1_alice_1", "EUW1_alice_2"} {
+		if got := fake.callCount("GetMatch " + id); got != 1 {
+			t.Errorf("%s fetched %d times, want once for all the streams", id, got)
+		}
+		if got := fake.callCount("GetTimeline " + id); got != 1 {
+			t.Errorf("timeline of %s fetched %d times, want once for all the streams", id, got)
+		}
+	}
+	if got := fake.callCount("ListMatchIDs alice#euw"); got != 1 {
+		t.Errorf("listed match ids %d times, want once for all the streams", got)
+	}
+	if got := len(out.records(TimelineLaneDiffs)); got != 8 {
+		t.Errorf("got %d lane diffs, want 8", got)
+	}
+	if got := len(out.records(TimelineKills)); got != 2 {
+		t.Errorf("got %d kills, want 2", got)
+	}
+	for _, stream := range []string{Matches, MatchTimelines, TimelineLaneDiffs, TimelineKills} {
+		if bookmark, ok := out.bookmark(stream, "alice#euw"); !ok || !bookmark.Equal(date("2024-03-01")) {
+			t.Errorf("%s bookmark = %v, want the end date", stream, bookmark)
+		}
+	}
+}
+
+func TestRunSyncEmitsMatchWithoutTimeline(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	fake.fail("GetTimeline EUW1_alice_1", &NotFoundError{APIError{StatusCode: http.StatusNotFound}})
+
+	out, report, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches, MatchTimelines, TimelineLaneDiffs, TimelineKills), nil, fake)
+
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("err = %v, want a *PartialError", err)
+	}
+	if got := len(out.records(Matches)); got != 1 {
+		t.Errorf("got %d matches, want the one whose timeline is missing", got)
+	}
+	if got := len(out.records(MatchTimelines)) + len(out.records(TimelineLaneDiffs)) + len(out.records(TimelineKills)); got != 0 {
+		t.Errorf("got %d timeline records, want none", got)
+	}
+	for stream, skipped := range map[string]int{Matches: 0, MatchTimelines: 1, TimelineLaneDiffs: 1, TimelineKills: 1} {
+		if got := report.Streams[stream].Skipped; got != skipped {
+			t.Errorf("%s skipped %d matches, want %d", stream, got, skipped)
+		}
+	}
+}
+
+func TestRunSyncEmitsTimelineWithoutMatch(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	notFound := &NotFoundError{APIError{StatusCode: http.StatusNotFound}}
+	fake.fail("GetMatch EUW1_alice_1", notFound, notFound)
+	// A transient timeline error gets the task retried despite the missing
+	// match.
+	fake.fail("GetTimeline EUW1_alice_1", &RateLimitedError{APIError: APIError{StatusCode: http.StatusTooManyRequests}})
+
+	out, report, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches, MatchTimelines, TimelineKills), nil, fake)
+
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("err = %v, want a *PartialError", err)
+	}
+	if got := matchIDs(out.records(MatchTimelines)); fmt.Sprint(got) != "[EUW1_alice_1]" {
+		t.Errorf("timelines = %v, want the one whose match is missing", got)
+	}
+	if got := len(out.records(Matches)) + len(out.records(TimelineKills)); got != 0 {
+		t.Errorf("got %d records needing the match, want none", got)
+	}
+	for stream, skipped := range map[string]int{Matches: 1, MatchTimelines: 0, TimelineKills: 1} {
+		if got := report.Streams[stream].Skipped; got != skipped {
+			t.Errorf("%s skipped %d matches, want %d", stream, got, skipped)
+		}
+	}
+	for _, skip := range partial.Skipped {
+		if !errors.As(skip.Err, &notFound) || errors.As(skip.Err, new(*RateLimitedError)) {
+			t.Errorf("skip of %s = %v, want the error of the match", skip.Stream, skip.Err)
+		}
+	}
+}
+
+func TestRunSyncMatchStreamsAtDifferentBookmarks(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	// Timelines were selected after matches were synced up to February.
+	state := &singer.State{Value: map[string]map[string]int64{
+		Matches: {"alice#euw": date("2024-02-01").Unix()},
+	}}
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches, MatchTimelines), state, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != "[EUW1_alice_2]" {
+		t.Errorf("matches = %v, want the one after the bookmark", got)
+	}
+	if got := matchIDs(out.records(MatchTimelines)); fmt.Sprint(got) != "[EUW1_alice_1 EUW1_alice_2]" {
+		t.Errorf("timelines = %v, want both", got)
+	}
+	for _, stream := range []string{Matches, MatchTimelines} {
+		if bookmark, ok := out.bookmark(stream, "alice#euw"); !ok || !bookmark.Equal(date("2024-03-01")) {
+			t.Errorf("%s bookmark = %v, want the end date", stream, bookmark)
+		}
+	}
+}
+
+func TestRunSyncReportsSkippedMatches(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	fake.fail("GetMatch EUW1_alice_1", &NotFoundError{APIError{StatusCode: http.StatusNotFound}})
+
+	out, report, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), nil, fake)
+
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("err = %v, want a *PartialError", err)
+	}
+	if len(partial.Skipped) != 1 || partial.Skipped[0].MatchID != "EUW1_alice_1" {
+		t.Errorf("skipped = %+v", partial.Skipped)
+	}
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != "[EUW1_alice_2]" {
+		t.Errorf("matches = %v", got)
+	}
+	if report.Status != StatusPartial || report.Streams[Matches].Skipped != 1 {
+		t.Errorf("report = %s with %d skipped", report.Status, report.Streams[Matches].Skipped)
+	}
+}
+
+func TestRunSyncHoldsBookmarkBeforeSkippedMatch(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	fake.fail("GetMatch EUW1_alice_1", &ServerError{APIError{StatusCode: http.StatusBadGateway}},
+		&ServerError{APIError{StatusCode: http.StatusBadGateway}}, &ServerError{APIError{StatusCode: http.StatusBadGateway}})
+	c := testConfig("alice#euw")
+	c.BackfillWindowDays = 20
+
+	out, _, err := syncWith(t, c, selectStreams(Matches, MatchTimelines), nil, fake)
+
+	var partial *PartialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("err = %v, want a *PartialError", err)
+	}
+	// The match of the second window is emitted anyway.
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != "[EUW1_alice_2]" {
+		t.Errorf("matches = %v", got)
+	}
+	if bookmark, ok := out.bookmark(Matches, "alice#euw"); ok {
+		t.Errorf("matches bookmark = %v, want none before the skipped match", bookmark)
+	}
+	if bookmark, ok := out.bookmark(MatchTimelines, "alice#euw"); !ok || !bookmark.Equal(date("2024-03-01")) {
+		t.Errorf("timelines bookmark = %v, want the end date", bookmark)
+	}
+
+	// The next run lists the skipped match again.
+	state := out.state()
+	out, _, err = syncWith(t, c, selectStreams(Matches, MatchTimelines), state, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := matchIDs(out.records(Matches)); fmt.Sprint(got) != "[EUW1_alice_1 EUW1_alice_2]" {
+		t.Errorf("matches = %v, want the skipped one too", got)
+	}
+	if bookmark, ok := out.bookmark(Matches, "alice#euw"); !ok || !bookmark.Equal(date("2024-03-01")) {
+		t.Errorf("matches bookmark = %v, want the end date", bookmark)
+	}
+}
+
+func TestRunSyncRetriesTransientErrors(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	rateLimited := &RateLimitedError{APIError: APIError{StatusCode: http.StatusTooManyRequests}}
+	fake.fail("GetMatch EUW1_alice_1", rateLimited, &ServerError{APIError{StatusCode: http.StatusBadGateway}})
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := len(out.records(Matches)); got != 1 {
+		t.Errorf("got %d matches, want 1", got)
+	}
+	if got := fake.callCount("GetMatch EUW1_alice_1"); got != 3 {
+		t.Errorf("match fetched %d times, want 3", got)
+	}
+}
+
+func TestRunSyncRetriesNetworkErrors(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	refused := &url.Error{Op: "Get", URL: "https://europe.api.riotgames.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	fake.fail("GetMatch EUW1_alice_1", refused, fmt.Errorf("reading the body: %w", context.DeadlineExceeded))
+
+	out, _, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), nil, fake)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := len(out.records(Matches)); got != 1 {
+		t.Errorf("got %d matches, want 1", got)
+	}
+	if got := fake.callCount("GetMatch EUW1_alice_1"); got != 3 {
+		t.Errorf("match fetched %d times, want 3", got)
+	}
+}
+
+func TestRunSyncHandsTasksOfRejectedKeyOver(t *testing.T) {
+	// The healthy key holds on to the task of one player until the rejected
+	// key has taken the task of the other, so that there is a task to hand
+	// over.
+	tried := make(chan struct{})
+	var once sync.Once
+	rejected := newFakeRiot()
+	rejected.onCall = func(ctx context.Context, call string) error {
+		once.Do(func() { close(tried) })
+		return &UnauthorizedError{APIError{StatusCode: http.StatusForbidden}}
+	}
+	healthy := newFakeRiot()
+	healthy.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	healthy.addPlayer("bob#euw", date("2024-01-10"))
+	healthy.onCall = func(ctx context.Context, call string) error {
+		select {
+		case <-tried:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	out, report, err := syncWith(t, testConfig("alice#euw", "bob#euw"), selectStreams(Matches), nil, rejected, healthy)
+	if err != nil {
+		t.Fatalf("RunSync: %s", err)
+	}
+	if got := len(out.records(Matches)); got != 3 {
+		t.Errorf("got %d matches, want 3", got)
+	}
+	if report.Keys[0].Quarantined == "" || report.Keys[1].Quarantined != "" {
+		t.Errorf("keys = %+v, want only key 0 quarantined", report.Keys)
+	}
+}
+
+func TestRunSyncFailsWithoutHealthyKeys(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	fake.onCall = func(ctx context.Context, call string) error {
+		return &UnauthorizedError{APIError{StatusCode: http.StatusUnauthorized}}
+	}
+
+	_, report, err := syncWith(t, testConfig("alice#euw"), selectStreams(Matches), nil, fake)
+
+	var fatal *FatalError
+	if !errors.As(err, &fatal) || !errors.Is(err, errNoHealthyKeys) {
+		t.Fatalf("err = %v, want a *FatalError for running out of keys", err)
+	}
+	if report.Status != StatusFailed {
+		t.Errorf("report status = %s", report.Status)
+	}
+}
+
+func TestRunSyncAbortsOverMaxFailures(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-01-11"), date("2024-01-12"))
+	notFound := &NotFoundError{APIError{StatusCode: http.StatusNotFound}}
+	for i := 1; i <= 3; i++ {
+		fake.fail(fmt.Sprintf("GetMatch EUW1_alice_%d", i), notFound)
+	}
+	c := testConfig("alice#euw")
+	c.MaxFailures = map[string]int{Matches: 1}
+
+	out, _, err := syncWith(t, c, selectStreams(Matches), nil, fake)
+
+	var fatal *FatalError
+	if !errors.As(err, &fatal) || fatal.Stream != Matches {
+		t.Fatalf("err = %v, want a *FatalError for %s", err, Matches)
+	}
+	if _, ok := out.bookmark(Matches, "alice#euw"); ok {
+		t.Error("bookmark advanced by an aborted run")
+	}
+}
+
+func TestRunSyncWritesStateOnCancel(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	fake.addPlayer("bob#euw", date("2024-01-10"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.onCall = func(ctx context.Context, call string) error {
+		if call == "GetMatch EUW1_bob_1" {
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	}
+	c := testConfig("alice#euw", "bob#euw")
+	c.BackfillWindowDays = 30
+
+	var buf bytes.Buffer
+	_, err := runTestSync(ctx, t, &buf, c, selectStreams(Matches), nil, fake)
+	out := decodeOutput(t, buf.Bytes())
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	last := out.messages[len(out.messages)-1]
+	if last["type"] != "STATE" {
+		t.Errorf("last message is a %s, want the final STATE", last["type"])
+	}
+	if bookmark, ok := out.bookmark(Matches, "bob#euw"); ok && !bookmark.Before(date("2024-01-31")) {
+		t.Errorf("bob's bookmark moved past the interrupted window to %s", bookmark)
+	}
+}
+
+// brokenWriter fails every write, like a pipe to a target that exited, and
+// closes broken on the first one.
+type brokenWriter struct {
+	once   sync.Once
+	broken chan struct{}
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.broken) })
+	return 0, errors.New("broken pipe")
+}
+
+func TestRunSyncAbortsOnBrokenOutput(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"), date("2024-02-10"))
+	w := &brokenWriter{broken: make(chan struct{})}
+	// The output is buffered and flushed with the STATE of the first window,
+	// so the second window waits for the write to fail and the run to abort.
+	fake.onCall = func(ctx context.Context, call string) error {
+		if call != "GetMatch EUW1_alice_2" {
+			return nil
+		}
+		select {
+		case <-w.broken:
+		case <-time.After(5 * time.Second):
+			return errors.New("output never written")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	c := testConfig("alice#euw")
+	c.BackfillWindowDays = 30
+
+	_, err := runTestSync(context.Background(), t, w, c, selectStreams(Matches), nil, fake)
+
+	var fatal *FatalError
+	if !errors.As(err, &fatal) || !strings.Contains(err.Error(), "broken pipe") {
+		t.Fatalf("err = %v, want a *FatalError for the broken output", err)
+	}
+}
+
+func TestCatalogRoundTrip(t *testing.T) {
+	catalog := CreateCatalog()
+	b, err := json.Marshal(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := singer.LoadCatalog(path)
+	if err != nil {
+		t.Fatalf("LoadCatalog: %s", err)
+	}
+	if len(loaded.Streams) != len(catalog.Streams) {
+		t.Fatalf("got %d streams, want %d", len(loaded.Streams), len(catalog.Streams))
+	}
+	// Properties may come back in another order, so the schemas are compared
+	// as decoded JSON.
+	for i, stream := range catalog.Streams {
+		want, got := schemaValue(t, stream.Schema), schemaValue(t, loaded.Streams[i].Schema)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s schema changed by the round trip:\n got %v\nwant %v", stream.Stream, got, want)
+		}
+	}
+}
+
+func schemaValue(t *testing.T, schema *jsonschema.Schema) interface{} {
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestWriteRecordDoesNotCountDroppedRecords(t *testing.T) {
+	tap := singer.NewTapWithWriter(io.Discard)
+	tap.SetLogger(quietLogger{})
+	tap.SetValidation(singer.ValidationDrop)
+	defer tap.Close()
+	tap.WriteSchema("dropped_records", map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"id": map[string]interface{}{"type": "string"}},
+	}, nil)
+	r := &syncRun{t: tap}
+	before := testutil.ToFloat64(recordsTotal.WithLabelValues("dropped_records"))
+
+	if written, err := r.writeRecord("dropped_records", map[string]interface{}{"id": 1}); written || err != nil {
+		t.Errorf("invalid record: written = %t, err = %v, want it dropped", written, err)
+	}
+	if written, err := r.writeRecord("dropped_records", map[string]interface{}{"id": "a"}); !written || err != nil {
+		t.Errorf("valid record: written = %t, err = %v", written, err)
+	}
+	if got := testutil.ToFloat64(recordsTotal.WithLabelValues("dropped_records")) - before; got != 1 {
+		t.Errorf("counted %v records, want only the written one", got)
+	}
+}
+
+func TestLaneDiffs(t *testing.T) {
+	fake := newFakeRiot()
+	fake.addPlayer("alice#euw", date("2024-01-10"))
+	match, _ := fake.GetMatch(context.Background(), "EUW1_alice_1")
+	timeline, _ := fake.GetTimeline(context.Background(), "EUW1_alice_1")
+	// A support without a lane opponent.
+	match.Info.Participants = append(match.Info.Participants,
+		&lol.Participant{ParticipantID: 5, PUUID: "support", TeamID: 100, TeamPosition: "UTILITY"})
+	timeline.Frames = append(timeline.Frames, MatchFrame{PlayerID: "support", Timestamp: 600020, TotalGold: 2000})
+
+	diffs := laneDiffs("EUW1_alice_1", match, timeline, []int{10, 15})
+
+	if len(diffs) != 3 {
+		t.Fatalf("got %d lane diffs, want 3 at minute 10 and none past the end of the game", len(diffs))
+	}
+	alice := diffs[0]
+	if alice.Puuid != "alice#euw" || alice.Minute != 10 || alice.Gold != 1500 || alice.CS != 80 {
+		t.Errorf("alice = %+v", alice)
+	}
+	if alice.OpponentPuuid != fakeOpponent || *alice.GoldDiff != 100 || *alice.CSDiff != 10 {
+		t.Errorf("alice diffs = %+v", alice)
+	}
+	if opponent := diffs[1]; *opponent.GoldDiff != -100 {
+		t.Errorf("opponent gold diff = %v, want -100", *opponent.GoldDiff)
+	}
+	if support := diffs[2]; support.OpponentPuuid != "" || support.GoldDiff != nil {
+		t.Errorf("support = %+v, want no diffs", support)
+	}
+}
+
+func TestMapZone(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		x, y float64
+		want string
+	}{
+		{"blue fountain", 554, 581, ZoneBlueBase},
+		{"red fountain", 14340, 14390, ZoneRedBase},
+		{"top lane corner", 1200, 13800, ZoneTopLane},
+		{"mid lane center", 7500, 7500, ZoneMidLane},
+		{"bot lane corner", 13800, 1200, ZoneBotLane},
+		{"baron pit", 5007, 10471, ZoneRiver},
+		{"dragon pit", 9866, 4414, ZoneRiver},
+		{"blue side blue buff", 3821, 7901, ZoneBlueTopJungle},
+		{"blue side red buff", 7765, 4020, ZoneBlueBotJungle},
+		{"red side red buff", 7101, 10900, ZoneRedTopJungle},
+		{"red side blue buff", 11131, 6990, ZoneRedBotJungle},
+		{"off the map", -100, 20000, ZoneUnknown},
+	} {
+		if got := mapZone(tc.x, tc.y); got != tc.want {
+			t.Errorf("%s: mapZone(%v, %v) = %s, want %s", tc.name, tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestTimelineKills(t *testing.T) {
+	match := &lol.Match{Info: &lol.MatchInfo{Participants: []*lol.Participant{
+		{ParticipantID: 1, PUUID: "top", TeamID: 100, TeamPosition: "TOP", ChampionName: "Garen"},
+		{ParticipantID: 2, PUUID: "jungle", TeamID: 100, TeamPosition: "JUNGLE", ChampionName: "Vi"},
+		{ParticipantID: 6, PUUID: "enemy top", TeamID: 200, TeamPosition: "TOP", ChampionName: "Darius"},
+		{ParticipantID: 7, PUUID: "enemy jungle", TeamID: 200, TeamPosition: "JUNGLE", ChampionName: "Lee Sin"},
+	}}}
+	championKill := lol.MatchEventTypeChampionKill
+	dragon := lol.MatchEventTypeEliteMonsterKill
+	ward := lol.MatchEventTypeWardPlaced
+	timeline := &MatchTimeline{Events: []MatchEvent{
+		// A gank in top lane, shutting down the enemy top laner.
+		{Type: &championKill, Timestamp: 300000, KillerID: 1, VictimID: 6, AssistingParticipantIDs: []int{2},
+			Position: &lol.MatchPosition{X: 1200, Y: 9000}, ShutdownBounty: 150},
+		{Type: &ward, Timestamp: 310000, CreatorID: 2},
+		// A solo kill in the jungle.
+		{Type: &championKill, Timestamp: 400000, KillerID: 7, VictimID: 2,
+			Position: &lol.MatchPosition{X: 3821, Y: 7901}},
+		// An execution, by a turret.
+		{Type: &championKill, Timestamp: 500000, KillerID: 0, VictimID: 1,
+			Position: &lol.MatchPosition{X: 1200, Y: 10000}},
+		{Type: &dragon, Timestamp: 600000, KillerID: 2, MonsterType: "DRAGON",
+			Position: &lol.MatchPosition{X: 9866, Y: 4414}},
+	}}
+
+	kills := timelineKills("EUW1_1", match, timeline)
+
+	if len(kills) != 4 {
+		t.Fatalf("got %d kills, want 4", len(kills))
+	}
+	gank := kills[0]
+	if gank.EventIndex != 0 || gank.KillerChampion != "Garen" || gank.VictimPuuid != "enemy top" ||
+		fmt.Sprint(gank.AssistingPuuids) != "[jungle]" || gank.Zone != ZoneTopLane {
+		t.Errorf("gank = %+v", gank)
+	}
+	if gank.SoloKill || !gank.GankKill || !gank.Shutdown {
+		t.Errorf("gank flags = solo %v, gank %v, shutdown %v", gank.SoloKill, gank.GankKill, gank.Shutdown)
+	}
+	solo := kills[1]
+	if solo.EventIndex != 2 || !solo.SoloKill || solo.GankKill || solo.Shutdown || solo.Zone != ZoneBlueTopJungle {
+		t.Errorf("solo kill = %+v", solo)
+	}
+	if execution := kills[2]; execution.KillerPuuid != "" || execution.SoloKill {
+		t.Errorf("execution = %+v, want no killer and no solo kill", execution)
+	}
+	if objective := kills[3]; objective.Type != "ELITE_MONSTER_KILL" || objective.KillerTeamID != 100 ||
+		objective.MonsterType != "DRAGON" || objective.Zone != ZoneRiver || objective.SoloKill {
+		t.Errorf("objective = %+v", objective)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper answering with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestRiotServiceCallsAreCancelledWithTheirContext(t *testing.T) {
+	service := newRiotService(context.Background(), "key", 0, "euw1", nil, nil, nil)
+	service.transport.limiter = &rateLimiter{}
+	service.transport.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := map[string]func() error{
+		"GetAccount": func() error {
+			_, err := service.GetAccount(ctx, "alice#euw")
+			return err
+		},
+		"GetMatch": func() error {
+			_, err := service.GetMatch(ctx, "EUW1_1")
+			return err
+		},
+		"GetLeagueEntries": func() error {
+			_, err := service.GetLeagueEntries(ctx, "puuid")
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: err = %v, want the deadline of its context", name, err)
+		}
+	}
+}
+
+func TestRiotServiceSendsOneRequestPerCall(t *testing.T) {
+	var urls []string
+	service := newRiotService(context.Background(), "key", 0, "euw1", nil, nil, nil)
+	service.transport.limiter = &rateLimiter{}
+	service.transport.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		urls = append(urls, r.URL.String())
+		return storedResponse(r, []byte(`{"metadata": {"matchId": "EUW1_1"}, "info": {}}`)), nil
+	})}
+
+	if _, err := service.GetMatch(context.Background(), "EUW1_1"); err != nil {
+		t.Fatalf("GetMatch: %s", err)
+	}
+	if want := []string{"https://europe.api.riotgames.com/lol/match/v5/matches/EUW1_1"}; fmt.Sprint(urls) != fmt.Sprint(want) {
+		t.Errorf("requests = %v, want %v", urls, want)
+	}
+}
+
+func TestArchiveIndexesCachedResponsesOnce(t *testing.T) {
+	dir := t.TempDir()
+	requests := 0
+	for run := 0; run < 2; run++ {
+		archive, err := openArchive(filepath.Join(dir, "archive"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache, err := openCache(filepath.Join(dir, "cache"), defaultCacheTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := newRiotService(context.Background(), "key", 0, "euw1", nil, archive, cache)
+		service.transport.limiter = &rateLimiter{}
+		service.transport.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			return storedResponse(r, []byte(`{"metadata": {"matchId": "EUW1_1"}, "info": {}}`)), nil
+		})}
+		for i := 0; i < 2; i++ {
+			if match, err := service.GetMatch(context.Background(), "EUW1_1"); err != nil || match.Metadata.MatchID != "EUW1_1" {
+				t.Fatalf("run %d: GetMatch = %v, %v", run, match, err)
+			}
+		}
+		archive.Close()
+		cache.Close()
+	}
+
+	if requests != 1 {
+		t.Errorf("sent %d requests, want 1, the rest coming from the cache", requests)
+	}
+	index, err := os.ReadFile(filepath.Join(dir, "archive", archiveIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(index, []byte("\n")); lines != 1 {
+		t.Errorf("got %d index lines, want 1:\n%s", lines, index)
+	}
+}
+
+func TestReplaySkipsUndecodableIndexLines(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := openArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newRiotService(context.Background(), "key", 0, "euw1", nil, archive, nil)
+	service.transport.limiter = &rateLimiter{}
+	service.transport.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return storedResponse(r, []byte(`{"metadata": {"matchId": "EUW1_1"}, "info": {}}`)), nil
+	})}
+	if _, err := service.GetMatch(context.Background(), "EUW1_1"); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+	index, err := os.OpenFile(filepath.Join(dir, archiveIndex), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A line cut short by a crash.
+	index.WriteString(`{"time": "2024-01-01T00:00:00Z", "endpoint": "match", "url": "https://europe.api.riotg`)
+	index.Close()
+
+	services, err := newReplayServices(context.Background(), &Config{ReplayDir: dir, Server: "euw1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, err := services[0].GetMatch(context.Background(), "EUW1_1"); err != nil || match.Metadata.MatchID != "EUW1_1" {
+		t.Errorf("GetMatch = %v, %v, want the archived match", match, err)
+	}
+}
+
+func TestReplayRejectsBadHashes(t *testing.T) {
+	dir := t.TempDir()
+	line := `{"time": "2024-01-01T00:00:00Z", "endpoint": "match", "url": "https://europe.api.riotgames.com/lol/match/v5/matches/EUW1_1", "sha256": "a"}` + "\n"
+	if err := os.WriteFile(filepath.Join(dir, archiveIndex), []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newReplayTransport(dir); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("err = %v, want the bad hash of line 1 rejected", err)
+	}
+}
+
+func TestApplicationRateLimitHoldsEveryRequestOfTheKey(t *testing.T) {
+	limited := make(chan time.Time, 1)
+	var mu sync.Mutex
+	calls := 0
+	service := newRiotService(context.Background(), "key", 0, "euw1", nil, nil, nil)
+	service.transport.limiter = &rateLimiter{}
+	service.transport.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			limited <- time.Now()
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": []string{"1"}, "X-Rate-Limit-Type": []string{"application"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+		return storedResponse(r, []byte(`{"metadata": {"matchId": "EUW1_1"}, "info": {}}`)), nil
+	})}
+
+	go service.GetMatch(context.Background(), "EUW1_1")
+	limitedAt := <-limited
+	// Wait for the 429 to reach the limiter, then send another request.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		service.transport.limiter.mu.Lock()
+		next := service.transport.limiter.next
+		service.transport.limiter.mu.Unlock()
+		if next.After(limitedAt) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the limiter of the key was not held by the 429")
+		}
+	}
+	if _, err := service.GetMatch(context.Background(), "EUW1_2"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(limitedAt); waited < time.Second {
+		t.Errorf("other request sent after %s, want it held for the Retry-After of 1s", waited)
+	}
+}
+
+// probedServices returns RiotServices whose requests are answered by respond.
+func probedServices(n int, respond func(*http.Request) *http.Response) func(context.Context) ([]RiotAPI, error) {
+	return func(ctx context.Context) ([]RiotAPI, error) {
+		services := make([]RiotAPI, n)
+		for i := range services {
+			service := newRiotService(ctx, "key", i, "euw1", nil, nil, nil)
+			service.transport.limiter = &rateLimiter{}
+			service.transport.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return respond(r), nil
+			})}
+			services[i] = service
+		}
+		return services, nil
+	}
+}
+
+func TestRunSyncFailsWhenProbeRejectsEveryKey(t *testing.T) {
+	tap := singer.NewTapWithWriter(io.Discard)
+	tap.SetLogger(quietLogger{})
+	state := &singer.State{Value: make(map[string]map[string]int64)}
+
+	report, err := runSync(context.Background(), tap, testConfig("alice#euw"), nil, state,
+		probedServices(2, func(r *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusUnauthorized,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(`{}`)),
+				Request:    r,
+			}
+		}))
+	tap.Close()
+
+	var fatal *FatalError
+	if !errors.As(err, &fatal) || !errors.Is(err, errNoHealthyKeys) {
+		t.Fatalf("err = %v, want a *FatalError for running out of keys", err)
+	}
+	if report.Status != StatusFailed || len(report.Keys) != 2 || report.Keys[0].Quarantined == "" || report.Keys[1].Quarantined == "" {
+		t.Errorf("report = %s with keys %+v, want both keys quarantined", report.Status, report.Keys)
+	}
+}
+
+func TestClassifyKey(t *testing.T) {
+	for header, want := range map[string]keyClass{
+		"":                 keyUnknown,
+		"20:1,100:120":     keyDevelopment,
+		"500:10,30000:600": keyProduction,
+		"100:1,1000:120":   keyProduction,
+		"20:1,100:120,5:1": keyDevelopment,
+	} {
+		if got := classifyKey(parseRateLimits(header)); got != want {
+			t.Errorf("classifyKey(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package tap
+
+import (
+	"bytes"
+	"context"
+	"github.com/nmorvil/singer-tap-riot/pkg/singer"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const maxRetries = 3
+
+const (
+	endpointAccountByRiotID = "account-v1.getByRiotId"
+	endpointMatchIDs        = "match-v5.getMatchIdsByPUUID"
+	endpointMatch           = "match-v5.getMatch"
+	endpointTimeline        = "match-v5.getTimeline"
+	endpointLeagueEntries   = "league-v4.getLeagueEntriesByPUUID"
+	endpointUnknown         = "unknown"
+)
+
+// endpointPatterns maps request paths to Riot API method names, which are
+// used to label errors instead of paths full of puuids and match ids.
+var endpointPatterns = []struct {
+	pattern  *regexp.Regexp
+	endpoint string
+}{
+	{regexp.MustCompile(`^/riot/account/v1/accounts/by-riot-id/[^/]+/[^/]+$`), endpointAccountByRiotID},
+	{regexp.MustCompile(`^/lol/match/v5/matches/by-puuid/[^/]+/ids$`), endpointMatchIDs},
+	{regexp.MustCompile(`^/lol/match/v5/matches/[^/]+/timeline$`), endpointTimeline},
+	{regexp.MustCompile(`^/lol/match/v5/matches/[^/]+$`), endpointMatch},
+	{regexp.MustCompile(`^/lol/league/v4/entries/by-puuid/[^/]+$`), endpointLeagueEntries},
+	{regexp.MustCompile(`^/lol/status/v4/platform-data$`), endpointPlatformData},
+}
+
+func endpointName(path string) string {
+	for _, p := range endpointPatterns {
+		if p.pattern.MatchString(path) {
+			return p.endpoint
+		}
+	}
+	return endpointUnknown
+}
+
+// regionName returns the platform or routing value a request was sent to,
+// e.g. "euw1" for euw1.api.riotgames.com.
+func regionName(host string) string {
+	region, _, _ := strings.Cut(host, ".")
+	return region
+}
+
+// transport is the http client every request of a RiotService goes through,
+// golio's included. It binds requests without a context of their own to the
+// sync context, answers from the cache when it can, spaces requests out
+// with the key's rate limiter, retries 429 and 503 responses, and turns error
+// responses into the typed errors of api_errors.go.
+type transport struct {
+	ctx      context.Context
+	client   *http.Client
+	limiter  *rateLimiter
+	keyIndex int
+	metrics  metricWriter
+	// archive, if set, gets the body of every successful response.
+	archive *archive
+	// cache, if set, is looked up before sending a request and gets the body
+	// of every successful response.
+	cache *responseCache
+
+	// For the run report: requests sent and nanoseconds spent waiting on
+	// rate limits.
+	requests atomic.Int64
+	waited   atomic.Int64
+}
+
+// metricWriter is where the transport logs its http_request_duration timers,
+// usually the singer.Tap.
+type metricWriter interface {
+	WriteMetric(m singer.Metric)
+}
+
+func (t *transport) Do(r *http.Request) (*http.Response, error) {
+	if r.Context() == context.Background() {
+		r = r.WithContext(t.ctx)
+	}
+	if t.cache != nil {
+		if body, ok := t.cachedBody(r); ok {
+			// Cached responses are archived too, so that an archive can
+			// replay any run.
+			if t.archive != nil {
+				if err := t.archiveResponse(r, body); err != nil {
+					return nil, err
+				}
+			}
+			return storedResponse(r, body), nil
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := t.limiter.wait(r.Context())
+		t.observeWait("limiter", time.Since(start))
+		if err != nil {
+			return nil, err
+		}
+		start = time.Now()
+		resp, err := t.client.Do(r)
+		t.requests.Add(1)
+		t.timeRequest(r, resp, time.Since(start))
+		if err != nil {
+			requestsTotal.WithLabelValues(endpointName(r.URL.Path), "error", keyLabel(t.keyIndex)).Inc()
+			return nil, err
+		}
+		requestsTotal.WithLabelValues(endpointName(r.URL.Path), strconv.Itoa(resp.StatusCode), keyLabel(t.keyIndex)).Inc()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if t.archive != nil || t.cache != nil {
+				return t.storeResponse(r, resp)
+			}
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		apiErr := newAPIError(resp, endpointName(r.URL.Path), regionName(r.URL.Host), t.keyIndex)
+		if attempt >= maxRetries {
+			return nil, apiErr
+		}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			d := retryAfter(resp.Header)
+			requestRetriesTotal.WithLabelValues(endpointName(r.URL.Path)).Inc()
+			if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("X-Rate-Limit-Type") == "application" {
+				// The whole key is over its limit, not just this endpoint:
+				// every request of the key waits in the limiter, this one
+				// included.
+				t.limiter.backOff(d)
+				continue
+			}
+			t.observeWait("retry_after", d)
+			if err := wait(r.Context(), d); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, apiErr
+		}
+	}
+}
+
+// storeResponse reads the body of resp once, archives and caches it, and
+// replaces it with an in-memory copy for the caller to read.
+func (t *transport) storeResponse(r *http.Request, resp *http.Response) (*http.Response, error) {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if t.archive != nil {
+		if err := t.archiveResponse(r, body); err != nil {
+			return nil, err
+		}
+	}
+	if t.cache != nil {
+		if err := t.cacheResponse(r, body); err != nil {
+			return nil, err
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// timeRequest logs an http_request_duration timer for a request, resp being
+// nil if it got no response.
+func (t *transport) timeRequest(r *http.Request, resp *http.Response, d time.Duration) {
+	if t.metrics == nil {
+		return
+	}
+	tags := map[string]interface{}{
+		"endpoint": endpointName(r.URL.Path),
+		"region":   regionName(r.URL.Host),
+		"status":   "failed",
+	}
+	if resp != nil {
+		tags["http_status_code"] = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			tags["status"] = "succeeded"
+		}
+	}
+	t.metrics.WriteMetric(singer.Metric{
+		Type:   singer.TimerMetric,
+		Metric: "http_request_duration",
+		Value:  d.Seconds(),
+		Tags:   tags,
+	})
+}
+
+// storedResponse returns a 200 response to req with body, for responses
+// answered from disk instead of the network.
+func storedResponse(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (t *transport) observeWait(cause string, d time.Duration) {
+	t.waited.Add(int64(d))
+	observeRateLimitWait(t.keyIndex, cause, d)
+}
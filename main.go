@@ -1,59 +1,133 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/nmorvil/singer-tap-riot/internal/tap"
 	"github.com/nmorvil/singer-tap-riot/pkg/singer"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit codes let orchestrators tell a run that skipped some players or
+// matches apart from one that failed outright.
+const (
+	exitOK          = 0
+	exitFailed      = 1
+	exitPartial     = 2
+	exitInterrupted = 130
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run does the work of main and returns the exit code, so that deferred
+// calls, such as flushing the tap's output, happen before exiting.
+func run() int {
 	var (
-		configPath    = flag.String("config", "", "Path to config file (required)")
-		statePath     = flag.String("state", "", "Path to state file")
-		catalogPath   = flag.String("catalog", "", "Path to catalog file")
-		discoveryMode = flag.Bool("discover", false, "Run in discovery mode")
-		outputPath    = flag.String("output", "", "Path to output file")
+		configPath     = flag.String("config", "", "Path to config file (required)")
+		statePath      = flag.String("state", "", "Path to state file")
+		catalogPath    = flag.String("catalog", "", "Path to catalog file")
+		propertiesPath = flag.String("properties", "", "Path to catalog file, for older Singer runners (alias of --catalog)")
+		discoveryMode  = flag.Bool("discover", false, "Run in discovery mode")
+		outputPath     = flag.String("output", "", "Path to output file")
+		aboutMode      = flag.Bool("about", false, "Print the tap's name, version, capabilities and settings")
+		aboutFormat    = flag.String("format", "text", "Format of the --about output: text or json")
+		logFormat      = flag.String("log-format", "text", "Format of the logs: text or json")
+		logLevel       = flag.String("log-level", "info", "Minimum level of the logs: debug, info, warn or error")
+		metricsAddr    = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on during the sync, e.g. :9090")
+		reportPath     = flag.String("report", "", "Path to write the run report to, in addition to stderr")
+		replayDir      = flag.String("replay", "", "Sync from an archive written with archive_dir instead of calling the Riot API")
 	)
 
+	flag.Parse()
+
+	if *aboutMode {
+		if err := tap.WriteAbout(os.Stdout, *aboutFormat); err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		return exitOK
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Print(err)
+		return exitFailed
+	}
+	logger, err := singer.NewLogger(os.Stderr, *logFormat, level)
+	if err != nil {
+		log.Print(err)
+		return exitFailed
+	}
+
+	// Without this a write to a closed stdout kills the process with SIGPIPE
+	// before the tap can notice the broken pipe and stop cleanly.
+	signal.Ignore(syscall.SIGPIPE)
+
 	var singerTap *singer.Tap
 	if *outputPath == "" {
 		singerTap = singer.NewTap()
 	} else {
-		f, err := os.Open(*outputPath)
+		f, err := os.Create(*outputPath)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error(err.Error())
+			return exitFailed
 		}
 		defer f.Close()
 		singerTap = singer.NewTapWithWriter(f)
 	}
-
-	flag.Parse()
+	singerTap.SetLogger(logger)
+	defer singerTap.Close()
 
 	if *discoveryMode {
 		err := tap.RunDiscovery(singerTap)
+		if err == nil {
+			err = singerTap.Close()
+		}
 		if err != nil {
-			log.Fatal(err)
+			logger.Error(err.Error())
+			return exitFailed
 		}
-		return
+		return exitOK
 	}
 
 	if *configPath == "" {
 		flag.Usage()
-		log.Fatal("Error: --config is required")
+		logger.Error("--config is required")
+		return exitFailed
 	}
 
 	cfg, err := tap.LoadConfig(*configPath)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error(err.Error())
+		return exitFailed
 	}
+	cfg.ReplayDir = *replayDir
 
+	if *catalogPath == "" {
+		*catalogPath = *propertiesPath
+	}
 	catalog := tap.CreateCatalog()
 	if *catalogPath != "" {
-		catalog, err = singer.LoadCatalog(*catalogPath)
+		userCatalog, err := singer.LoadCatalog(*catalogPath)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error(err.Error())
+			return exitFailed
+		}
+		var warnings []string
+		catalog, warnings = singer.MergeCatalog(catalog, userCatalog)
+		for _, warning := range warnings {
+			singerTap.LogWarn("Catalog out of date", "warning", warning)
 		}
 	}
 
@@ -61,12 +135,85 @@ func main() {
 	if *statePath != "" {
 		state, err = singer.LoadState(*statePath)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error(err.Error())
+			return exitFailed
 		}
 	} else {
 		state = &singer.State{Value: make(map[string]map[string]int64)}
 	}
 
-	tap.RunSync(singerTap, cfg, catalog, state)
+	if *metricsAddr != "" {
+		listener, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			logger.Error(err.Error())
+			return exitFailed
+		}
+		defer listener.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", tap.MetricsHandler())
+		go http.Serve(listener, mux)
+		singerTap.Log("Serving metrics", "addr", listener.Addr().String())
+	}
+
+	// The first SIGINT/SIGTERM cancels the sync so the final state gets
+	// written; restoring the default handlers lets a second one kill the tap.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	report, err := tap.RunSync(ctx, singerTap, cfg, catalog, state)
+	// The output is flushed before picking the exit code, since messages
+	// written after the last STATE can still fail to make it out.
+	closeErr := singerTap.Close()
+	if closeErr != nil && report != nil {
+		report.Status = tap.StatusFailed
+		report.Error = closeErr.Error()
+	}
+	if report != nil {
+		if err := writeReport(report, *reportPath); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	if closeErr != nil {
+		if !errors.Is(err, closeErr) {
+			logger.Error(closeErr.Error())
+		}
+		return exitFailed
+	}
+	if err != nil {
+		var partial *tap.PartialError
+		switch {
+		case errors.As(err, &partial):
+			return exitPartial
+		case errors.Is(err, context.Canceled):
+			return exitInterrupted
+		default:
+			return exitFailed
+		}
+	}
+	return exitOK
+}
 
+// writeReport writes the run report to stderr on a single line, and indented
+// to path if set.
+func writeReport(report *tap.Report, path string) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "REPORT: %s\n", b)
+	if path == "" {
+		return nil
+	}
+	b, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
 }
@@ -0,0 +1,100 @@
+package singer
+
+import (
+	"fmt"
+	"github.com/invopop/jsonschema"
+	"strings"
+)
+
+// userMetadata are the metadata keys a user may set in a catalog. Everything
+// else comes from discovery.
+var userMetadata = []string{"selected", "replication-method", "replication-key"}
+
+// MergeCatalog reconciles a user supplied catalog with a freshly discovered
+// one. The result has the discovered streams and schemas, with the selections
+// of the user catalog applied on top. Streams and fields of the user catalog
+// that were not discovered are reported as warnings and dropped.
+func MergeCatalog(discovered, user *Catalog) (*Catalog, []string) {
+	var warnings []string
+
+	merged := &Catalog{Streams: make([]Stream, len(discovered.Streams))}
+	index := make(map[string]int, len(discovered.Streams))
+	for i, stream := range discovered.Streams {
+		stream.Metadata = append([]StreamMetadata(nil), stream.Metadata...)
+		for j, meta := range stream.Metadata {
+			stream.Metadata[j].Metadata = copyMetadata(meta.Metadata)
+		}
+		merged.Streams[i] = stream
+		index[stream.TapStreamID] = i
+	}
+
+	for _, userStream := range user.Streams {
+		i, ok := index[userStream.TapStreamID]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("stream %q no longer exists, ignoring it", userStream.TapStreamID))
+			continue
+		}
+		stream := &merged.Streams[i]
+		for _, userMeta := range userStream.Metadata {
+			if !hasBreadcrumb(stream.Schema, userMeta.Breadcrumb) {
+				warnings = append(warnings, fmt.Sprintf("field %q of stream %q no longer exists, ignoring it",
+					strings.Join(userMeta.Breadcrumb, "."), userStream.TapStreamID))
+				continue
+			}
+			meta := stream.metadataFor(userMeta.Breadcrumb)
+			for _, key := range userMetadata {
+				if value, ok := userMeta.Metadata[key]; ok {
+					meta.Metadata[key] = value
+				}
+			}
+		}
+	}
+
+	return merged, warnings
+}
+
+// metadataFor returns the metadata entry of a breadcrumb, adding an empty one
+// if the stream has none yet.
+func (s *Stream) metadataFor(breadcrumb []string) *StreamMetadata {
+	for i, meta := range s.Metadata {
+		if strings.Join(meta.Breadcrumb, "\x00") == strings.Join(breadcrumb, "\x00") {
+			return &s.Metadata[i]
+		}
+	}
+	s.Metadata = append(s.Metadata, StreamMetadata{
+		Breadcrumb: append([]string{}, breadcrumb...),
+		Metadata:   make(map[string]interface{}),
+	})
+	return &s.Metadata[len(s.Metadata)-1]
+}
+
+// hasBreadcrumb reports whether a breadcrumb such as
+// ["properties", "info", "properties", "gameId"] points into schema.
+func hasBreadcrumb(schema *jsonschema.Schema, breadcrumb []string) bool {
+	for i := 0; i < len(breadcrumb); i++ {
+		if schema == nil {
+			return false
+		}
+		switch breadcrumb[i] {
+		case "properties":
+			if i+1 >= len(breadcrumb) || schema.Properties == nil {
+				return false
+			}
+			i++
+			schema, _ = schema.Properties.Get(breadcrumb[i])
+		case "items":
+			schema = schema.Items
+		default:
+			return false
+		}
+	}
+	return schema != nil
+}
+
+func copyMetadata(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,141 @@
+package singer
+
+import (
+	"github.com/invopop/jsonschema"
+	"strings"
+	"testing"
+)
+
+type testMatch struct {
+	ID   string `json:"id"`
+	Info struct {
+		GameID int `json:"gameId"`
+	} `json:"info"`
+	Participants []struct {
+		Puuid string `json:"puuid"`
+	} `json:"participants"`
+}
+
+func testCatalog() *Catalog {
+	reflector := jsonschema.Reflector{DoNotReference: true}
+	return &Catalog{Streams: []Stream{
+		{
+			TapStreamID: "matches",
+			Stream:      "matches",
+			Schema:      reflector.Reflect(new(testMatch)),
+			Metadata: []StreamMetadata{{
+				Breadcrumb: []string{},
+				Metadata:   map[string]interface{}{"inclusion": "available", "key-properties": []string{"id"}},
+			}},
+		},
+		{
+			TapStreamID: "elos",
+			Stream:      "elos",
+			Schema:      reflector.Reflect(new(testMatch)),
+			Metadata: []StreamMetadata{{
+				Breadcrumb: []string{},
+				Metadata:   map[string]interface{}{"inclusion": "available"},
+			}},
+		},
+	}}
+}
+
+func userStream(id string, metadata ...StreamMetadata) Stream {
+	return Stream{TapStreamID: id, Stream: id, Metadata: metadata}
+}
+
+func selected(breadcrumb ...string) StreamMetadata {
+	return StreamMetadata{
+		Breadcrumb: append([]string{}, breadcrumb...),
+		Metadata:   map[string]interface{}{"selected": true, "inclusion": "automatic"},
+	}
+}
+
+func findMetadata(s Stream, breadcrumb ...string) map[string]interface{} {
+	for _, meta := range s.Metadata {
+		if strings.Join(meta.Breadcrumb, ".") == strings.Join(breadcrumb, ".") {
+			return meta.Metadata
+		}
+	}
+	return nil
+}
+
+func TestMergeCatalogCarriesSelections(t *testing.T) {
+	discovered := testCatalog()
+	user := &Catalog{Streams: []Stream{userStream("matches", selected())}}
+
+	merged, warnings := MergeCatalog(discovered, user)
+
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v", warnings)
+	}
+	meta := findMetadata(merged.Streams[0])
+	if meta["selected"] != true {
+		t.Errorf("matches metadata = %v, want it selected", meta)
+	}
+	if meta["inclusion"] != "available" {
+		t.Errorf("inclusion = %v, want the discovered one, not the user's", meta["inclusion"])
+	}
+	if got := GetSelectedStreams(merged); len(got) != 1 || got[0] != "matches" {
+		t.Errorf("selected streams = %v", got)
+	}
+}
+
+func TestMergeCatalogDropsStaleEntries(t *testing.T) {
+	discovered := testCatalog()
+	user := &Catalog{Streams: []Stream{
+		userStream("summoners", selected()),
+		userStream("matches", selected(), selected("properties", "gameMode")),
+	}}
+
+	merged, warnings := MergeCatalog(discovered, user)
+
+	if len(warnings) != 2 ||
+		!strings.Contains(warnings[0], `stream "summoners"`) ||
+		!strings.Contains(warnings[1], `field "properties.gameMode" of stream "matches"`) {
+		t.Errorf("warnings = %q, want the stale stream and field", warnings)
+	}
+	if len(merged.Streams) != 2 {
+		t.Errorf("got %d streams, want the 2 discovered", len(merged.Streams))
+	}
+	if meta := findMetadata(merged.Streams[0], "properties", "gameMode"); meta != nil {
+		t.Errorf("stale field kept with metadata %v", meta)
+	}
+}
+
+func TestMergeCatalogNestedBreadcrumbs(t *testing.T) {
+	discovered := testCatalog()
+	user := &Catalog{Streams: []Stream{userStream("matches",
+		selected("properties", "info", "properties", "gameId"),
+		selected("properties", "participants", "items", "properties", "puuid"),
+		selected("properties", "info", "properties", "gameMode"),
+	)}}
+
+	merged, warnings := MergeCatalog(discovered, user)
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "properties.info.properties.gameMode") {
+		t.Errorf("warnings = %q, want only the missing nested field", warnings)
+	}
+	for _, breadcrumb := range [][]string{
+		{"properties", "info", "properties", "gameId"},
+		{"properties", "participants", "items", "properties", "puuid"},
+	} {
+		if meta := findMetadata(merged.Streams[0], breadcrumb...); meta["selected"] != true {
+			t.Errorf("%v: metadata = %v, want it selected", breadcrumb, meta)
+		}
+	}
+}
+
+func TestMergeCatalogLeavesDiscoveredUntouched(t *testing.T) {
+	discovered := testCatalog()
+	user := &Catalog{Streams: []Stream{userStream("matches", selected(), selected("properties", "id"))}}
+
+	MergeCatalog(discovered, user)
+
+	if meta := findMetadata(discovered.Streams[0]); meta["selected"] != nil {
+		t.Errorf("discovered metadata mutated: %v", meta)
+	}
+	if len(discovered.Streams[0].Metadata) != 1 {
+		t.Errorf("discovered stream got %d metadata entries, want 1", len(discovered.Streams[0].Metadata))
+	}
+}
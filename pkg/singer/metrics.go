@@ -0,0 +1,85 @@
+package singer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// recordCountInterval is how often the record_count counters are logged.
+const recordCountInterval = time.Minute
+
+const (
+	CounterMetric = "counter"
+	TimerMetric   = "timer"
+)
+
+// Metric is a Singer metric, logged as `INFO METRIC: {...}` for monitoring
+// to scrape. The line is written to stderr as is, whatever the log format,
+// unless the logger is a MetricLogger.
+type Metric struct {
+	Type   string                 `json:"type"`
+	Metric string                 `json:"metric"`
+	Value  interface{}            `json:"value"`
+	Tags   map[string]interface{} `json:"tags,omitempty"`
+}
+
+// MetricLogger is implemented by loggers that log metrics their own way.
+type MetricLogger interface {
+	Metric(m Metric)
+}
+
+// WriteMetric logs m.
+func (t *Tap) WriteMetric(m Metric) {
+	t.logMu.Lock()
+	defer t.logMu.Unlock()
+	if l, ok := t.logger.(MetricLogger); ok {
+		l.Metric(m)
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "INFO METRIC: %s\n", b)
+}
+
+func (t *Tap) countRecord(stream string) {
+	t.countMu.Lock()
+	defer t.countMu.Unlock()
+	t.recordCounts[stream]++
+}
+
+// reportRecordCounts logs the record_count counters every
+// recordCountInterval until the output is closed.
+func (t *Tap) reportRecordCounts() {
+	ticker := time.NewTicker(recordCountInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flushRecordCounts()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// flushRecordCounts logs, per stream, the records written since the last
+// call, as Singer counters do.
+func (t *Tap) flushRecordCounts() {
+	t.countMu.Lock()
+	counts := t.recordCounts
+	t.recordCounts = make(map[string]int64)
+	t.countMu.Unlock()
+
+	for stream, count := range counts {
+		t.WriteMetric(Metric{
+			Type:   CounterMetric,
+			Metric: "record_count",
+			Value:  count,
+			Tags:   map[string]interface{}{"endpoint": stream},
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package singer
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/invopop/jsonschema"
+)
+
+// Integers are capped to what fits a BIGINT column, otherwise some targets
+// fall back to NUMERIC or text.
+const (
+	integerMinimum = json.Number("-9223372036854775808")
+	integerMaximum = json.Number("9223372036854775807")
+)
+
+// NormalizeSchema rewrites, in place, a schema reflected from Go types into
+// one that common targets load without surprises:
+//
+//   - every field but the key properties is nullable, i.e. ["null", type],
+//     and only the key properties are required,
+//   - $schema, $id and additionalProperties: false are removed,
+//   - integers get a 64 bit minimum and maximum.
+//
+// Formats such as date-time, set by the reflector for time.Time or through a
+// `jsonschema:"format=..."` tag, are kept.
+func NormalizeSchema(schema *jsonschema.Schema, keyProperties []string) *jsonschema.Schema {
+	keys := make(map[string]bool, len(keyProperties))
+	for _, key := range keyProperties {
+		keys[key] = true
+	}
+	schema.Version = ""
+	schema.ID = ""
+	normalizeSchema(schema, false, keys)
+	schema.Required = keyProperties
+	return schema
+}
+
+// normalizeSchema normalizes s and its subschemas. Properties named in keys
+// are left non-nullable.
+func normalizeSchema(s *jsonschema.Schema, nullable bool, keys map[string]bool) {
+	if s == nil || s == jsonschema.TrueSchema || s == jsonschema.FalseSchema {
+		return
+	}
+	if s.AdditionalProperties == jsonschema.FalseSchema {
+		s.AdditionalProperties = nil
+	}
+	s.Required = nil
+	if s.Type == "integer" {
+		if s.Minimum == "" {
+			s.Minimum = integerMinimum
+		}
+		if s.Maximum == "" {
+			s.Maximum = integerMaximum
+		}
+	}
+
+	if s.Properties != nil {
+		for pair := s.Properties.Oldest(); pair != nil; pair = pair.Next() {
+			normalizeSchema(pair.Value, !keys[pair.Key], nil)
+		}
+	}
+	for _, p := range s.PatternProperties {
+		normalizeSchema(p, true, nil)
+	}
+	normalizeSchema(s.AdditionalProperties, true, nil)
+	normalizeSchema(s.Items, true, nil)
+	for _, sub := range s.AnyOf {
+		normalizeSchema(sub, false, nil)
+	}
+	for _, sub := range s.OneOf {
+		normalizeSchema(sub, false, nil)
+	}
+
+	if nullable {
+		makeNullable(s)
+	}
+}
+
+// makeNullable turns the type of s into ["null", type]. jsonschema.Schema
+// only has room for a single type, so the pair goes into Extras, which is
+// merged into the marshalled schema.
+func makeNullable(s *jsonschema.Schema) {
+	if s == nil || s.Type == "" {
+		return
+	}
+	if s.Extras == nil {
+		s.Extras = make(map[string]any)
+	}
+	s.Extras["type"] = []string{"null", s.Type}
+	s.Type = ""
+}
+
+// unmarshalSchema decodes a schema whose types may be arrays, as written by
+// NormalizeSchema, which jsonschema.Schema cannot decode on its own: array
+// types are put back into Extras.
+func unmarshalSchema(data []byte) (*jsonschema.Schema, error) {
+	// Numbers are kept as json.Number, or the 64 bit integer bounds would be
+	// rounded to float64.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	types := make(map[string][]interface{})
+	liftTypes(raw, "", types)
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var schema jsonschema.Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	restoreTypes(&schema, "", types)
+	return &schema, nil
+}
+
+// liftTypes removes the array types found in the properties and items of a
+// decoded schema, recording them by path.
+func liftTypes(raw interface{}, path string, types map[string][]interface{}) {
+	schema, ok := raw.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if t, ok := schema["type"].([]interface{}); ok {
+		types[path] = t
+		delete(schema, "type")
+	}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, property := range properties {
+			liftTypes(property, path+"/"+name, types)
+		}
+	}
+	liftTypes(schema["items"], path+"[]", types)
+}
+
+func restoreTypes(s *jsonschema.Schema, path string, types map[string][]interface{}) {
+	if s == nil {
+		return
+	}
+	if t, ok := types[path]; ok {
+		if s.Extras == nil {
+			s.Extras = make(map[string]any)
+		}
+		s.Extras["type"] = t
+	}
+	if s.Properties != nil {
+		for pair := s.Properties.Oldest(); pair != nil; pair = pair.Next() {
+			restoreTypes(pair.Value, path+"/"+pair.Key, types)
+		}
+	}
+	restoreTypes(s.Items, path+"[]", types)
+}
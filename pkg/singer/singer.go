@@ -1,19 +1,35 @@
 package singer
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/invopop/jsonschema"
 	"io"
+	"log/slog"
 	"os"
+	"sync"
+	"time"
 )
 
+// messageBuffer is how many messages may be queued before writers block.
+const messageBuffer = 1024
+
+// ErrClosed is returned when writing a message to a closed Tap.
+var ErrClosed = errors.New("singer: tap is closed")
+
+// ErrDropped is returned when writing a record that ValidationDrop left out.
+// The tap is still fine, but the record was not written.
+var ErrDropped = errors.New("singer: invalid record dropped")
+
 type MessageType string
 
 const (
-	RecordMessage MessageType = "RECORD"
-	SchemaMessage MessageType = "SCHEMA"
-	StateMessage  MessageType = "STATE"
+	RecordMessage          MessageType = "RECORD"
+	SchemaMessage          MessageType = "SCHEMA"
+	StateMessage           MessageType = "STATE"
+	ActivateVersionMessage MessageType = "ACTIVATE_VERSION"
 )
 
 type Message interface {
@@ -22,17 +38,45 @@ type Message interface {
 }
 
 type Record struct {
-	Stream string      `json:"stream"`
-	Data   interface{} `json:"data"`
+	Stream        string      `json:"stream"`
+	Data          interface{} `json:"data"`
+	TimeExtracted time.Time   `json:"time_extracted"`
+	// Version is the version of a full-table stream the record belongs to,
+	// 0 if the stream is not versioned.
+	Version int64 `json:"version,omitempty"`
 }
 
 func (r Record) Type() MessageType { return RecordMessage }
 
 func (r Record) Write(w io.Writer) error {
-	return json.NewEncoder(w).Encode(map[string]interface{}{
+	msg := map[string]interface{}{
 		"type":   string(r.Type()),
 		"stream": r.Stream,
 		"record": r.Data,
+	}
+	if !r.TimeExtracted.IsZero() {
+		msg["time_extracted"] = r.TimeExtracted.UTC().Format(time.RFC3339Nano)
+	}
+	if r.Version != 0 {
+		msg["version"] = r.Version
+	}
+	return json.NewEncoder(w).Encode(msg)
+}
+
+// ActivateVersion tells the target that every record of a stream written
+// with a version older than Version can be dropped.
+type ActivateVersion struct {
+	Stream  string `json:"stream"`
+	Version int64  `json:"version"`
+}
+
+func (a ActivateVersion) Type() MessageType { return ActivateVersionMessage }
+
+func (a ActivateVersion) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":    string(a.Type()),
+		"stream":  a.Stream,
+		"version": a.Version,
 	})
 }
 
@@ -77,85 +121,351 @@ func (s State) Write(w io.Writer) error {
 	return json.NewEncoder(w).Encode(msg)
 }
 
+func (s State) copy() State {
+	value := make(map[string]map[string]int64, len(s.Value))
+	for stream, bookmarks := range s.Value {
+		value[stream] = make(map[string]int64, len(bookmarks))
+		for key, bookmark := range bookmarks {
+			value[stream][key] = bookmark
+		}
+	}
+	return State{value}
+}
+
+// Tap writes Singer messages to its output. It is safe for concurrent use:
+// messages are queued on a bounded channel and written in order by a single
+// goroutine through a buffered writer, which is flushed after every STATE. A
+// STATE is therefore only emitted once every message queued before it has
+// been written. Close must be called to flush the remaining messages.
+//
+// The first error hit writing the output is latched: queued messages are
+// dropped and every later write fails with it.
 type Tap struct {
-	output io.Writer
-	logger Logger
+	output   *bufio.Writer
+	messages chan Message
+	done     chan struct{}
+	// closed is set by Close, under closeMu so that no send races the
+	// closing of messages.
+	closeMu sync.RWMutex
+	closed  bool
+	logMu   sync.Mutex
+	logger  Logger
+
+	errMu  sync.Mutex
+	err    error
+	failed chan struct{}
+
+	countMu      sync.Mutex
+	recordCounts map[string]int64
+
+	validation ValidationMode
+	validMu    sync.Mutex
+	schemas    map[string]interface{}
+	validCount map[string]*ValidationCount
 }
 
+// Logger is a leveled logger taking a message followed by key-value pairs,
+// as *slog.Logger does.
 type Logger interface {
-	Info(format string, args ...interface{})
-	Error(format string, args ...interface{})
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
 }
 
+// StderrLogger logs every level to stderr in the text format of log/slog.
+//
+// Deprecated: Use NewLogger, which also filters by level.
 type StderrLogger struct{}
 
-func (l StderrLogger) Info(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "INFO: "+format+"\n", args...)
+var _ Logger = StderrLogger{}
+
+var stderrLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+func (StderrLogger) Debug(msg string, args ...any) { stderrLogger.Debug(msg, args...) }
+func (StderrLogger) Info(msg string, args ...any)  { stderrLogger.Info(msg, args...) }
+func (StderrLogger) Warn(msg string, args ...any)  { stderrLogger.Warn(msg, args...) }
+func (StderrLogger) Error(msg string, args ...any) { stderrLogger.Error(msg, args...) }
+
+// NewLogger returns a logger writing to w in the "text" or "json" format of
+// log/slog.
+func NewLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
 }
 
-func (l StderrLogger) Error(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...)
+func NewTap() *Tap {
+	return NewTapWithWriter(os.Stdout)
 }
 
-func NewTap() *Tap {
-	return &Tap{
-		output: os.Stdout,
-		logger: StderrLogger{},
+func NewTapWithWriter(w io.Writer) *Tap {
+	t := &Tap{
+		output:       bufio.NewWriter(w),
+		messages:     make(chan Message, messageBuffer),
+		done:         make(chan struct{}),
+		logger:       slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		failed:       make(chan struct{}),
+		schemas:      make(map[string]interface{}),
+		validCount:   make(map[string]*ValidationCount),
+		recordCounts: make(map[string]int64),
 	}
+	go t.writeMessages()
+	go t.reportRecordCounts()
+	return t
 }
 
-func NewTapWithWriter(w io.Writer) *Tap {
-	return &Tap{
-		output: w,
-		logger: StderrLogger{},
+func (t *Tap) writeMessages() {
+	defer close(t.done)
+	for msg := range t.messages {
+		if t.Err() != nil {
+			continue
+		}
+		err := msg.Write(t.output)
+		if err == nil && msg.Type() == StateMessage {
+			err = t.output.Flush()
+		}
+		if err != nil {
+			t.fail(fmt.Errorf("failed to write output: %w", err))
+		}
+	}
+	if t.Err() == nil {
+		if err := t.output.Flush(); err != nil {
+			t.fail(fmt.Errorf("failed to write output: %w", err))
+		}
+	}
+}
+
+func (t *Tap) fail(err error) {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	if t.err == nil {
+		t.err = err
+		close(t.failed)
+	}
+}
+
+// Err returns the error that stopped the tap from writing its output, if any:
+// a write error, or an invalid record in ValidationFail mode.
+func (t *Tap) Err() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return t.err
+}
+
+// Failed returns a channel that is closed once writing the output failed.
+func (t *Tap) Failed() <-chan struct{} {
+	return t.failed
+}
+
+func (t *Tap) send(msg Message) error {
+	if err := t.Err(); err != nil {
+		return err
+	}
+	t.closeMu.RLock()
+	defer t.closeMu.RUnlock()
+	if t.closed {
+		return ErrClosed
+	}
+	t.messages <- msg
+	return nil
+}
+
+// Close writes the queued messages, flushes the output and logs the last
+// record counts. Messages written after Close fail with ErrClosed.
+func (t *Tap) Close() error {
+	t.closeMu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.messages)
 	}
+	t.closeMu.Unlock()
+	<-t.done
+	t.flushRecordCounts()
+	return t.Err()
 }
 
 func (t *Tap) SetLogger(l Logger) {
 	t.logger = l
 }
 
+// SetValidation makes WriteRecord check records against the last SCHEMA
+// written for their stream.
+func (t *Tap) SetValidation(mode ValidationMode) {
+	t.validation = mode
+}
+
+// ValidationCounts returns, per stream, how many records were valid and
+// invalid.
+func (t *Tap) ValidationCounts() map[string]ValidationCount {
+	t.validMu.Lock()
+	defer t.validMu.Unlock()
+	counts := make(map[string]ValidationCount, len(t.validCount))
+	for stream, count := range t.validCount {
+		counts[stream] = *count
+	}
+	return counts
+}
+
+// validateRecord returns a *ValidationError if record does not match the
+// schema of its stream.
+func (t *Tap) validateRecord(stream string, record interface{}) *ValidationError {
+	if t.validation == ValidationOff {
+		return nil
+	}
+	t.validMu.Lock()
+	schema, ok := t.schemas[stream]
+	t.validMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	value, err := toJSONValue(record)
+	if err != nil {
+		// Left for the writer to report.
+		return nil
+	}
+	path, reason, valid := validate(schema, value, "record")
+
+	t.validMu.Lock()
+	defer t.validMu.Unlock()
+	count := t.validCount[stream]
+	if count == nil {
+		count = &ValidationCount{}
+		t.validCount[stream] = count
+	}
+	if valid {
+		count.Valid++
+		return nil
+	}
+	count.Invalid++
+	return &ValidationError{stream, path, reason}
+}
+
+// WriteRecord writes a record extracted now. It returns ErrDropped for an
+// invalid record in ValidationDrop mode.
 func (t *Tap) WriteRecord(stream string, record interface{}) error {
-	r := Record{
-		Stream: stream,
-		Data:   record,
+	return t.writeRecord(Record{
+		Stream:        stream,
+		Data:          record,
+		TimeExtracted: time.Now(),
+	})
+}
+
+// WriteVersionedRecord writes a record of the given version of a full-table
+// stream, see WriteActivateVersion. It returns ErrDropped as WriteRecord does.
+func (t *Tap) WriteVersionedRecord(stream string, version int64, record interface{}) error {
+	return t.writeRecord(Record{
+		Stream:        stream,
+		Data:          record,
+		TimeExtracted: time.Now(),
+		Version:       version,
+	})
+}
+
+// WriteActivateVersion makes version the current version of stream, once
+// all its records were written.
+func (t *Tap) WriteActivateVersion(stream string, version int64) error {
+	return t.send(ActivateVersion{stream, version})
+}
+
+func (t *Tap) writeRecord(record Record) error {
+	if err := t.validateRecord(record.Stream, record.Data); err != nil {
+		switch t.validation {
+		case ValidationFail:
+			t.fail(err)
+			return err
+		case ValidationDrop:
+			t.LogWarn("Dropping invalid record", err.logArgs()...)
+			return ErrDropped
+		default:
+			t.LogWarn("Invalid record", err.logArgs()...)
+		}
 	}
-	return r.Write(t.output)
+	if err := t.send(record); err != nil {
+		return err
+	}
+	t.countRecord(record.Stream)
+	return nil
 }
 
 func (t *Tap) WriteSchema(stream string, schema interface{}, keyProperties []string) error {
-	s := Schema{
+	if value, err := toJSONValue(schema); err == nil {
+		t.validMu.Lock()
+		t.schemas[stream] = value
+		t.validMu.Unlock()
+	}
+	return t.send(Schema{
 		Stream:        stream,
 		Schema:        schema,
 		KeyProperties: keyProperties,
-	}
-	return s.Write(t.output)
+	})
 }
 
 func (t *Tap) WriteSchemaFromStream(s Stream) error {
-	return t.WriteSchema(s.Stream, s.Schema, s.Metadata[0].Metadata["key-properties"].([]string))
+	return t.WriteSchema(s.Stream, s.Schema, s.KeyProperties())
 }
 
+// WriteState queues a copy of state, so the caller may keep updating it.
 func (t *Tap) WriteState(state *State) error {
-	return state.Write(t.output)
+	return t.send(state.copy())
 }
 
 func (t *Tap) WriteCatalog(catalog *Catalog) error {
-	return json.NewEncoder(t.output).Encode(catalog)
+	return t.send(catalogMessage{catalog})
 }
 
-func (t *Tap) Log(format string, args ...interface{}) {
+// Log, LogDebug, LogWarn and LogError log msg and key-value pairs at their
+// level.
+func (t *Tap) Log(msg string, args ...any) {
+	t.logMu.Lock()
+	defer t.logMu.Unlock()
 	if t.logger != nil {
-		t.logger.Info(format, args...)
+		t.logger.Info(msg, args...)
 	}
 }
 
-func (t *Tap) LogError(format string, args ...interface{}) {
+func (t *Tap) LogDebug(msg string, args ...any) {
+	t.logMu.Lock()
+	defer t.logMu.Unlock()
 	if t.logger != nil {
-		t.logger.Error(format, args...)
+		t.logger.Debug(msg, args...)
 	}
 }
 
+func (t *Tap) LogWarn(msg string, args ...any) {
+	t.logMu.Lock()
+	defer t.logMu.Unlock()
+	if t.logger != nil {
+		t.logger.Warn(msg, args...)
+	}
+}
+
+func (t *Tap) LogError(msg string, args ...any) {
+	t.logMu.Lock()
+	defer t.logMu.Unlock()
+	if t.logger != nil {
+		t.logger.Error(msg, args...)
+	}
+}
+
+// catalogMessage lets a discovery catalog go through the message queue.
+type catalogMessage struct {
+	catalog *Catalog
+}
+
+func (c catalogMessage) Type() MessageType { return "" }
+
+func (c catalogMessage) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(c.catalog)
+}
+
 type Catalog struct {
 	Streams []Stream `json:"streams"`
 }
@@ -167,6 +477,51 @@ type Stream struct {
 	Metadata    []StreamMetadata   `json:"metadata"`
 }
 
+// UnmarshalJSON decodes the stream schema with unmarshalSchema, so catalogs
+// holding nullable types can be loaded.
+func (s *Stream) UnmarshalJSON(data []byte) error {
+	type stream Stream
+	aux := struct {
+		*stream
+		Schema json.RawMessage `json:"schema"`
+	}{stream: (*stream)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.Schema) == 0 || string(aux.Schema) == "null" {
+		s.Schema = nil
+		return nil
+	}
+	schema, err := unmarshalSchema(aux.Schema)
+	if err != nil {
+		return err
+	}
+	s.Schema = schema
+	return nil
+}
+
+// KeyProperties returns the key-properties of the stream-level metadata.
+func (s Stream) KeyProperties() []string {
+	for _, meta := range s.Metadata {
+		if len(meta.Breadcrumb) != 0 {
+			continue
+		}
+		switch keys := meta.Metadata["key-properties"].(type) {
+		case []string:
+			return keys
+		case []interface{}:
+			properties := make([]string, 0, len(keys))
+			for _, key := range keys {
+				if name, ok := key.(string); ok {
+					properties = append(properties, name)
+				}
+			}
+			return properties
+		}
+	}
+	return nil
+}
+
 type StreamMetadata struct {
 	Breadcrumb []string               `json:"breadcrumb"`
 	Metadata   map[string]interface{} `json:"metadata"`
@@ -0,0 +1,31 @@
+package singer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWriteAfterCloseFails(t *testing.T) {
+	var buf bytes.Buffer
+	tap := NewTapWithWriter(&buf)
+	if err := tap.WriteRecord("players", map[string]interface{}{"id": 1}); err != nil {
+		t.Fatalf("WriteRecord: %s", err)
+	}
+	if err := tap.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if err := tap.WriteRecord("players", map[string]interface{}{"id": 2}); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteRecord after Close = %v, want ErrClosed", err)
+	}
+	if err := tap.WriteState(&State{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteState after Close = %v, want ErrClosed", err)
+	}
+	if err := tap.Close(); err != nil {
+		t.Errorf("second Close: %s", err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 1 {
+		t.Errorf("got %d messages, want the one written before Close", lines)
+	}
+}
@@ -0,0 +1,199 @@
+package singer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ValidationMode tells what WriteRecord does with records that do not match
+// the last SCHEMA of their stream.
+type ValidationMode string
+
+const (
+	// ValidationOff skips validation.
+	ValidationOff ValidationMode = ""
+	// ValidationFail latches the first invalid record as the tap's error.
+	ValidationFail ValidationMode = "fail"
+	// ValidationDrop logs invalid records and does not write them.
+	ValidationDrop ValidationMode = "drop"
+	// ValidationPass logs invalid records and writes them anyway.
+	ValidationPass ValidationMode = "pass"
+)
+
+// ParseValidationMode checks that s is a known validation mode.
+func ParseValidationMode(s string) (ValidationMode, error) {
+	switch mode := ValidationMode(s); mode {
+	case ValidationOff, ValidationFail, ValidationDrop, ValidationPass:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown validation mode %q, expected fail, drop or pass", s)
+	}
+}
+
+// ValidationCount counts the validated records of a stream.
+type ValidationCount struct {
+	Valid   int
+	Invalid int
+}
+
+// ValidationError describes a record that does not match its schema.
+type ValidationError struct {
+	Stream string
+	Path   string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s record at %s: %s", e.Stream, e.Path, e.Reason)
+}
+
+func (e *ValidationError) logArgs() []any {
+	return []any{"stream", e.Stream, "path", e.Path, "reason", e.Reason}
+}
+
+// toJSONValue turns v into the generic form encoding/json decodes into, so
+// that records and schemas can be walked the same way whatever their Go type.
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	return value, json.Unmarshal(b, &value)
+}
+
+// validate checks value against schema. It supports the subset of JSON Schema
+// the tap's schemas use: type, properties, required, additionalProperties,
+// items, enum and anyOf.
+func validate(schema, value interface{}, path string) (string, string, bool) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		// true, or a schema the validator does not understand.
+		if b, isBool := schema.(bool); isBool && !b {
+			return path, "no value is allowed here", false
+		}
+		return "", "", true
+	}
+
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if _, _, ok := validate(sub, value, path); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return path, "matches none of the anyOf schemas", false
+		}
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		return path, fmt.Sprintf("expected %v, got %s", t, jsonType(value)), false
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return path, fmt.Sprintf("%v is not one of %v", value, enum), false
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := s["properties"].(map[string]interface{})
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					return path, fmt.Sprintf("missing required property %q", name), false
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sub, ok := properties[key]
+			if !ok {
+				sub, ok = s["additionalProperties"]
+			}
+			if !ok {
+				continue
+			}
+			if p, reason, ok := validate(sub, v[key], path+"."+key); !ok {
+				return p, reason, false
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				if p, reason, ok := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); !ok {
+					return p, reason, false
+				}
+			}
+		}
+	}
+	return "", "", true
+}
+
+// matchesType checks a value against a "type" keyword, which is either a
+// type name or a list of them.
+func matchesType(t interface{}, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesTypeName(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if n, ok := name.(string); ok && matchesTypeName(n, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonType(value) == name
+	}
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return strings.ToLower(reflect.TypeOf(value).Kind().String())
+	}
+}
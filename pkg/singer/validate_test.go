@@ -0,0 +1,157 @@
+package singer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/invopop/jsonschema"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type testPlayer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Level int    `json:"level"`
+}
+
+func testPlayerSchema() interface{} {
+	reflector := jsonschema.Reflector{DoNotReference: true}
+	schema := NormalizeSchema(reflector.Reflect(new(testPlayer)), []string{"id"})
+	value, err := toJSONValue(schema)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+func TestValidate(t *testing.T) {
+	schema := testPlayerSchema()
+	for _, tc := range []struct {
+		name   string
+		record string
+		path   string
+		reason string
+	}{
+		{"valid", `{"id": "a", "name": "Alice", "level": 30}`, "", ""},
+		{"null in a nullable field", `{"id": "a", "name": null, "level": null}`, "", ""},
+		{"wrong type", `{"id": "a", "level": "thirty"}`, "record.level", "expected [null integer], got string"},
+		{"not an integer", `{"id": "a", "level": 1.5}`, "record.level", "expected [null integer], got number"},
+		{"missing required key", `{"name": "Alice"}`, "record", `missing required property "id"`},
+		{"null key", `{"id": null}`, "record.id", "expected string, got null"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tc.record), &value); err != nil {
+				t.Fatal(err)
+			}
+			path, reason, valid := validate(schema, value, "record")
+			if valid != (tc.reason == "") || path != tc.path || reason != tc.reason {
+				t.Errorf("validate = (%q, %q, %t), want (%q, %q, %t)",
+					path, reason, valid, tc.path, tc.reason, tc.reason == "")
+			}
+		})
+	}
+}
+
+func TestWriteRecordValidation(t *testing.T) {
+	for _, tc := range []struct {
+		mode    ValidationMode
+		written int
+		failed  bool
+	}{
+		// A failed tap stops writing, even the messages already queued.
+		{ValidationFail, 0, true},
+		{ValidationDrop, 1, false},
+		{ValidationPass, 2, false},
+		{ValidationOff, 2, false},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			var buf bytes.Buffer
+			tap := NewTapWithWriter(&buf)
+			tap.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+			tap.SetValidation(tc.mode)
+			if err := tap.WriteSchema("players", testPlayerSchema(), []string{"id"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tap.WriteRecord("players", testPlayer{ID: "a", Level: 30}); err != nil {
+				t.Errorf("valid record: %s", err)
+			}
+			err := tap.WriteRecord("players", map[string]interface{}{"id": "b", "level": "thirty"})
+			var invalid *ValidationError
+			if got := errors.As(err, &invalid); got != tc.failed {
+				t.Errorf("invalid record: err = %v", err)
+			}
+			if dropped := errors.Is(err, ErrDropped); dropped != (tc.mode == ValidationDrop) {
+				t.Errorf("invalid record: err = %v, want ErrDropped only when dropping", err)
+			}
+			// Close returns the error the tap failed with.
+			if err := tap.Close(); errors.As(err, &invalid) != tc.failed {
+				t.Errorf("Close() = %v", err)
+			}
+			if records := strings.Count(buf.String(), `"type":"RECORD"`); records != tc.written {
+				t.Errorf("wrote %d records, want %d", records, tc.written)
+			}
+			want := map[string]ValidationCount{"players": {Valid: 1, Invalid: 1}}
+			if tc.mode == ValidationOff {
+				want = map[string]ValidationCount{}
+			}
+			if got := tap.ValidationCounts(); !equalCounts(got, want) {
+				t.Errorf("ValidationCounts() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestValidationCountsPerStream(t *testing.T) {
+	tap := NewTapWithWriter(io.Discard)
+	tap.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tap.SetValidation(ValidationDrop)
+	for _, stream := range []string{"players", "teams"} {
+		if err := tap.WriteSchema(stream, testPlayerSchema(), []string{"id"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := []struct {
+		stream string
+		record interface{}
+	}{
+		{"players", testPlayer{ID: "a"}},
+		{"players", testPlayer{ID: "b"}},
+		{"players", map[string]interface{}{"name": "no id"}},
+		{"teams", map[string]interface{}{"id": 1}},
+		// Streams without a SCHEMA are not validated.
+		{"elos", map[string]interface{}{"id": 1}},
+	}
+	for _, r := range records {
+		if err := tap.WriteRecord(r.stream, r.record); err != nil && !errors.Is(err, ErrDropped) {
+			t.Fatal(err)
+		}
+	}
+	if err := tap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]ValidationCount{
+		"players": {Valid: 2, Invalid: 1},
+		"teams":   {Invalid: 1},
+	}
+	if got := tap.ValidationCounts(); !equalCounts(got, want) {
+		t.Errorf("ValidationCounts() = %v, want %v", got, want)
+	}
+}
+
+func equalCounts(a, b map[string]ValidationCount) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for stream, count := range a {
+		if b[stream] != count {
+			return false
+		}
+	}
+	return true
+}